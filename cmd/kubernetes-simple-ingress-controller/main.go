@@ -2,30 +2,131 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/server"
 	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"golang.org/x/sync/errgroup"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	host          string
-	port, tlsPort int
+	host                     string
+	adminHost                string
+	port, tlsPort, adminPort int
+	http3                    bool
+	ocspStapling             bool
+	ocspResponderURL         string
+
+	certificateExpiryThreshold time.Duration
+
+	sessionTicketSecret   string
+	sessionTicketRotation time.Duration
+
+	readHeaderTimeout, readTimeout, writeTimeout, idleTimeout time.Duration
+
+	maxConnections         int
+	connectionQueueTimeout time.Duration
+
+	trustedProxies  string
+	requestIDHeader string
+
+	accessLog, accessLogFormat string
+
+	compression                            bool
+	compressionEncodings, compressionTypes string
+	compressionMinSize                     int
+
+	cacheDir        string
+	cachePurgeToken string
+
+	rateLimitRedisURL string
+
+	otlpEndpoint       string
+	traceSamplingRatio float64
+	tracePropagators   string
+
+	proxyProtocol        bool
+	proxyProtocolTrusted string
+
+	backendKeepAlive, backendIdleConnTimeout        time.Duration
+	backendMaxIdleConns, backendMaxIdleConnsPerHost int
+
+	tlsMinVersion, tlsMaxVersion, tlsCipherSuites, tlsCurvePreferences, tlsALPNProtocols string
 )
 
 func main() {
 	flag.StringVar(&host, "host", "0.0.0.0", "the host to bind")
 	flag.IntVar(&port, "port", 80, "the insecure http port")
 	flag.IntVar(&tlsPort, "tls-port", 443, "the secure https port")
+	flag.StringVar(&adminHost, "admin-host", "", "the host to bind the admin api and metrics to, defaults to the host")
+	flag.IntVar(&adminPort, "admin-port", 10254, "the admin api and metrics port, 0 to disable")
+	flag.BoolVar(&http3, "http3", false, "serve HTTP/3 over QUIC on the tls port")
+	flag.BoolVar(&ocspStapling, "ocsp-stapling", true, "staple OCSP responses to served certificates")
+	flag.StringVar(&ocspResponderURL, "ocsp-responder-url", "", "override the OCSP responder url found in certificates")
+	flag.DurationVar(&certificateExpiryThreshold, "certificate-expiry-threshold", time.Hour*24*14,
+		"warn about certificates expiring within this duration")
+	flag.StringVar(&sessionTicketSecret, "session-ticket-secret", "",
+		"the namespace/name of a secret with a shared tls session ticket secret in "+watcher.SessionTicketSecretKey)
+	flag.DurationVar(&sessionTicketRotation, "session-ticket-rotation", time.Hour, "how often tls session ticket keys are rotated")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", time.Second*10, "the time allowed for clients to send request headers")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "the time allowed for clients to send the entire request, 0 for no timeout")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "the time allowed to write the response to clients, 0 for no timeout")
+	flag.DurationVar(&idleTimeout, "idle-timeout", time.Minute*2, "how long idle client connections are kept open")
+	flag.IntVar(&maxConnections, "max-connections", 0, "the maximum number of client connections per listener, 0 for no limit")
+	flag.DurationVar(&connectionQueueTimeout, "connection-queue-timeout", 0,
+		"how long connections beyond the maximum wait for a free slot before being dropped")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "",
+		"a comma-separated list of CIDRs of proxies whose X-Forwarded-For and Forwarded headers are trusted")
+	flag.StringVar(&requestIDHeader, "request-id-header", "X-Request-ID", "the header used to pass request ids to backends and clients")
+	flag.StringVar(&accessLog, "access-log", "stdout", "where access logs are written: stdout, stderr, off or a file path")
+	flag.StringVar(&accessLogFormat, "access-log-format", server.AccessLogFormatJSON,
+		"the access log format: json, combined or a go template of an AccessLogEntry")
+	flag.BoolVar(&compression, "compression", false, "compress the responses of every ingress")
+	flag.StringVar(&compressionEncodings, "compression-encodings", "br,zstd,gzip",
+		"a comma-separated list of content encodings offered to clients in order of preference")
+	flag.StringVar(&compressionTypes, "compression-types", strings.Join(server.DefaultCompressionTypes, ","),
+		"a comma-separated list of compressed media types")
+	flag.IntVar(&compressionMinSize, "compression-min-size", server.DefaultCompressionMinSize,
+		"the size in bytes below which responses are not compressed")
+	flag.StringVar(&cacheDir, "cache-dir", "", "the directory response caches spill to, empty to only cache in memory")
+	flag.StringVar(&cachePurgeToken, "cache-purge-token", "",
+		"the bearer token required to purge cached responses via the admin api, empty to disable purging")
+	flag.StringVar(&rateLimitRedisURL, "rate-limit-redis-url", "",
+		"the url of a redis (redis://host:6379/0) storing rate limits shared by every replica, empty to limit per replica")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"the url of an OpenTelemetry collector accepting OTLP over HTTP to export traces to, empty to disable tracing")
+	flag.Float64Var(&traceSamplingRatio, "trace-sampling-ratio", 1, "the ratio of new traces sampled when tracing is enabled")
+	flag.StringVar(&tracePropagators, "trace-propagators", "tracecontext,baggage",
+		"a comma-separated list of trace context propagators (tracecontext, baggage, b3, b3multi)")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "accept PROXY protocol v1 and v2 headers on the listeners")
+	flag.StringVar(&proxyProtocolTrusted, "proxy-protocol-trusted-cidrs", "",
+		"a comma-separated list of CIDRs allowed to send PROXY protocol headers, required with --proxy-protocol")
+	flag.DurationVar(&backendKeepAlive, "backend-keepalive", time.Second*30, "the tcp keep-alive period of backend connections")
+	flag.DurationVar(&backendIdleConnTimeout, "backend-idle-conn-timeout", time.Second*90, "how long idle backend connections are kept open")
+	flag.IntVar(&backendMaxIdleConns, "backend-max-idle-conns", 100, "the maximum number of idle connections per backend")
+	flag.IntVar(&backendMaxIdleConnsPerHost, "backend-max-idle-conns-per-host", 32, "the maximum number of idle connections per backend host")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "", "the minimum tls version (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&tlsMaxVersion, "tls-max-version", "", "the maximum tls version (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&tlsCipherSuites, "tls-cipher-suites", "", "a comma-separated list of tls 1.0-1.2 cipher suites")
+	flag.StringVar(&tlsCurvePreferences, "tls-curve-preferences", "", "a comma-separated list of curves (X25519, P256, P384, P521)")
+	flag.StringVar(&tlsALPNProtocols, "tls-alpn-protocols", "", "a comma-separated list of alpn protocols (h2, http/1.1)")
 	flag.Parse()
 
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -33,15 +134,87 @@ func main() {
 		func(err error) { log.Warn().Err(err).Msg("[k8s]") },
 	}
 
+	tlsPolicy, err := server.ParseTLSPolicy(tlsMinVersion, tlsMaxVersion, tlsCipherSuites, tlsCurvePreferences, tlsALPNProtocols)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid tls policy")
+	}
+	trustedProxyNetworks, err := server.ParseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid trusted proxies")
+	}
+	proxyProtocolTrustedNetworks, err := server.ParseTrustedProxies(proxyProtocolTrusted)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid proxy protocol trusted cidrs")
+	}
+	if proxyProtocol && len(proxyProtocolTrustedNetworks) == 0 {
+		log.Fatal().Msg("--proxy-protocol requires --proxy-protocol-trusted-cidrs")
+	}
+	accessLogger, err := getAccessLogger()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid access log")
+	}
+	var compressionPolicy *server.CompressionPolicy
+	if compression {
+		policy, err := server.ParseCompressionPolicy(compressionEncodings, compressionTypes, strconv.Itoa(compressionMinSize))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid compression settings")
+		}
+		compressionPolicy = &policy
+	}
+	var rateLimitStore server.RateLimitStore
+	if rateLimitRedisURL != "" {
+		rateLimitStore, err = server.NewRedisRateLimitStoreFromURL(rateLimitRedisURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid rate limit redis url")
+		}
+	}
+	tracePropagator, err := server.ParseTracePropagators(tracePropagators)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid trace propagators")
+	}
+	tracerProvider, err := getTracerProvider()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid otlp endpoint")
+	}
+
+	watcherOptions := []watcher.Option{
+		watcher.WithCertificateExpiryThreshold(certificateExpiryThreshold),
+	}
+	if sessionTicketSecret != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(sessionTicketSecret)
+		if err == nil && namespace == "" {
+			err = errors.New("expected namespace/name")
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid session ticket secret")
+		}
+		watcherOptions = append(watcherOptions, watcher.WithSessionTicketSecret(namespace, name))
+	}
+
 	client, err := kubernetes.NewForConfig(getKubernetesConfig())
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create kubernetes client")
 	}
 
-	s := server.New(server.WithHost(host), server.WithPort(port), server.WithTLSPort(tlsPort))
+	s := server.New(server.WithHost(host), server.WithPort(port), server.WithTLSPort(tlsPort),
+		server.WithAdminHost(adminHost), server.WithAdminPort(adminPort), server.WithHTTP3(http3),
+		server.WithOCSPStapling(ocspStapling), server.WithOCSPResponderURL(ocspResponderURL),
+		server.WithTLSPolicy(tlsPolicy), server.WithSessionTicketRotation(sessionTicketRotation),
+		server.WithReadHeaderTimeout(readHeaderTimeout), server.WithReadTimeout(readTimeout),
+		server.WithWriteTimeout(writeTimeout), server.WithIdleTimeout(idleTimeout),
+		server.WithMaxConnections(maxConnections), server.WithConnectionQueueTimeout(connectionQueueTimeout),
+		server.WithTrustedProxies(trustedProxyNetworks), server.WithRequestIDHeader(requestIDHeader),
+		server.WithAccessLogger(accessLogger),
+		server.WithCompression(compressionPolicy), server.WithCacheDir(cacheDir),
+		server.WithCachePurgeToken(cachePurgeToken), server.WithRateLimitStore(rateLimitStore),
+		server.WithTracerProvider(tracerProvider), server.WithTracePropagator(tracePropagator),
+		server.WithProxyProtocol(proxyProtocol), server.WithProxyProtocolTrusted(proxyProtocolTrustedNetworks),
+		server.WithBackendKeepAlive(backendKeepAlive), server.WithBackendIdleConnTimeout(backendIdleConnTimeout),
+		server.WithBackendMaxIdleConns(backendMaxIdleConns), server.WithBackendMaxIdleConnsPerHost(backendMaxIdleConnsPerHost))
+	watcherOptions = append(watcherOptions, watcher.WithEventObserver(s.ObserveWatcherEvent))
 	w := watcher.New(client, func(payload *watcher.Payload) {
 		s.Update(payload)
-	})
+	}, watcherOptions...)
 
 	eg, ctx := errgroup.WithContext(context.Background())
 	eg.Go(func() error {
@@ -50,11 +223,47 @@ func main() {
 	eg.Go(func() error {
 		return w.Run(ctx)
 	})
-	if err := eg.Wait(); err != nil {
+	err = eg.Wait()
+	if tp, ok := tracerProvider.(*sdktrace.TracerProvider); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		_ = tp.Shutdown(ctx)
+		cancel()
+	}
+	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
 }
 
+func getTracerProvider() (trace.TracerProvider, error) {
+	if otlpEndpoint == "" {
+		return noop.NewTracerProvider(), nil
+	}
+	exporter, err := server.NewOTLPExporter(otlpEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewTracerProvider(exporter, traceSamplingRatio), nil
+}
+
+func getAccessLogger() (*server.AccessLogger, error) {
+	var w io.Writer
+	switch accessLog {
+	case "off", "":
+		return nil, nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f, err := os.OpenFile(accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return server.NewAccessLogger(w, accessLogFormat)
+}
+
 func getKubernetesConfig() *rest.Config {
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// The built-in access log formats. Any other format is a text/template executed with an
+// AccessLogEntry.
+const (
+	AccessLogFormatJSON     = "json"
+	AccessLogFormatCombined = "combined"
+)
+
+// An AccessLogEntry describes a completed request.
+type AccessLogEntry struct {
+	Time      time.Time
+	RequestID string
+	ClientIP  string
+	Method    string
+	Host      string
+	Path      string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+
+	// TLSVersion and SNI are empty for plaintext requests.
+	TLSVersion string
+	SNI        string
+
+	// Ingress is the namespace/name of the matched ingress, empty if no ingress matched.
+	Ingress string
+	// UpstreamAddr and UpstreamLatency describe the last request to the backend, if any.
+	UpstreamAddr    string
+	UpstreamLatency time.Duration
+}
+
+// An AccessLogger writes an access log line for every request.
+type AccessLogger struct {
+	format string
+	tmpl   *template.Template
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAccessLogger creates a new AccessLogger writing to w in the given format.
+func NewAccessLogger(w io.Writer, format string) (*AccessLogger, error) {
+	l := &AccessLogger{format: format, w: w}
+	switch format {
+	case AccessLogFormatJSON, AccessLogFormatCombined:
+	default:
+		if !strings.HasSuffix(format, "\n") {
+			format += "\n"
+		}
+		var err error
+		l.tmpl, err = template.New("access-log").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %w", err)
+		}
+	}
+	return l, nil
+}
+
+func (l *AccessLogger) log(entry *AccessLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	switch l.format {
+	case AccessLogFormatJSON:
+		logger := zerolog.New(l.w)
+		logger.Log().
+			Time("time", entry.Time).
+			Str("request_id", entry.RequestID).
+			Str("client_ip", entry.ClientIP).
+			Str("method", entry.Method).
+			Str("host", entry.Host).
+			Str("path", entry.Path).
+			Str("proto", entry.Proto).
+			Int("status", entry.Status).
+			Int64("bytes", entry.Bytes).
+			Float64("duration", entry.Duration.Seconds()).
+			Str("referer", entry.Referer).
+			Str("user_agent", entry.UserAgent).
+			Str("tls_version", entry.TLSVersion).
+			Str("sni", entry.SNI).
+			Str("ingress", entry.Ingress).
+			Str("upstream_addr", entry.UpstreamAddr).
+			Float64("upstream_latency", entry.UpstreamLatency.Seconds()).
+			Send()
+	case AccessLogFormatCombined:
+		_, err = fmt.Fprintf(l.w, "%s - - [%s] %q %d %d %q %q\n",
+			orDash(entry.ClientIP), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.Method+" "+entry.Path+" "+entry.Proto, entry.Status, entry.Bytes,
+			orDash(entry.Referer), orDash(entry.UserAgent))
+	default:
+		err = l.tmpl.Execute(l.w, entry)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("failed to write access log")
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogOptions configure the access logs of an ingress.
+type accessLogOptions struct {
+	disabled   bool
+	sampleRate float64
+}
+
+func parseAccessLog(enabled, sampleRate string) (*accessLogOptions, error) {
+	opts := &accessLogOptions{sampleRate: 1}
+	if enabled != "" {
+		v, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enabled value: %s", enabled)
+		}
+		opts.disabled = !v
+	}
+	if sampleRate != "" {
+		var err error
+		if opts.sampleRate, err = strconv.ParseFloat(sampleRate, 64); err != nil || opts.sampleRate < 0 || opts.sampleRate > 1 {
+			return nil, fmt.Errorf("invalid sample rate, expected a number between 0 and 1: %s", sampleRate)
+		}
+	}
+	return opts, nil
+}
+
+// sampled returns true if a request should be logged.
+func (opts *accessLogOptions) sampled() bool {
+	if opts == nil {
+		return true
+	}
+	return !opts.disabled && (opts.sampleRate >= 1 || rand.Float64() < opts.sampleRate)
+}
+
+type requestInfoContextKey struct{}
+
+// requestInfo collects information about a request as it is served.
+type requestInfo struct {
+	start   time.Time
+	backend *routingTableBackend
+
+	upstreamAddr    string
+	upstreamLatency time.Duration
+	// upstreamError is why the backend failed to respond, if it did.
+	upstreamError string
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, info))
+}
+
+// getRequestInfo returns the information about the request, or nil if there is none.
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// recordUpstream records a request to the backend.
+func (info *requestInfo) recordUpstream(addr string, latency time.Duration) {
+	if info == nil {
+		return
+	}
+	info.upstreamAddr = addr
+	info.upstreamLatency = latency
+}
+
+// recordUpstreamError records why the backend failed to respond.
+func (info *requestInfo) recordUpstreamError(reason string) {
+	if info == nil {
+		return
+	}
+	info.upstreamError = reason
+}
+
+func (info *requestInfo) ingress() string {
+	if info.backend == nil {
+		return ""
+	}
+	return info.backend.proxy.namespace + "/" + info.backend.proxy.ingress
+}
+
+func newAccessLogEntry(r *http.Request, w *responseRecorder, info *requestInfo, requestIDHeader string) *AccessLogEntry {
+	entry := &AccessLogEntry{
+		Time:            info.start,
+		RequestID:       r.Header.Get(requestIDHeader),
+		Method:          r.Method,
+		Host:            r.Host,
+		Path:            r.URL.RequestURI(),
+		Proto:           r.Proto,
+		Status:          w.statusCode(),
+		Bytes:           w.bytes,
+		Duration:        time.Since(info.start),
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+		Ingress:         info.ingress(),
+		UpstreamAddr:    info.upstreamAddr,
+		UpstreamLatency: info.upstreamLatency,
+	}
+	if ip := clientIP(r); ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = tls.VersionName(r.TLS.Version)
+		entry.SNI = r.TLS.ServerName
+	}
+	return entry
+}
+
+// A responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// statusCode returns the response's status code. Handlers that don't write anything respond with 200.
+func (w *responseRecorder) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying response writer, for use by http.ResponseController.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	newServer := func(format string, annotations map[string]string) (*Server, *bytes.Buffer) {
+		var buf bytes.Buffer
+		logger, err := NewAccessLogger(&buf, format)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		s := New(WithAccessLogger(logger))
+		s.Update(newTestPayload(annotations, hostOf(backend)))
+		return s, &buf
+	}
+	get := func(s *Server, path string) {
+		r := httptest.NewRequest("GET", "http://www.example.com"+path, nil)
+		r.RemoteAddr = "203.0.113.1:1234"
+		r.Header.Set("User-Agent", "test")
+		r.Header.Set("X-Request-Id", "abc")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		s, buf := newServer(AccessLogFormatJSON, nil)
+		get(s, "/a?q=1")
+		var entry map[string]interface{}
+		if assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry)) {
+			assert.Equal(t, "abc", entry["request_id"])
+			assert.Equal(t, "203.0.113.1", entry["client_ip"])
+			assert.Equal(t, "/a?q=1", entry["path"])
+			assert.Equal(t, float64(201), entry["status"])
+			assert.Equal(t, float64(5), entry["bytes"])
+			assert.Equal(t, "default/example", entry["ingress"])
+			assert.Equal(t, hostOf(backend), entry["upstream_addr"])
+			assert.Greater(t, entry["upstream_latency"], float64(0))
+		}
+
+		buf.Reset()
+		get(s, "/unknown")
+		if assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry)) {
+			assert.Equal(t, float64(404), entry["status"], "unmatched requests should be logged")
+			assert.Equal(t, "", entry["ingress"])
+		}
+	})
+	t.Run("combined", func(t *testing.T) {
+		s, buf := newServer(AccessLogFormatCombined, nil)
+		get(s, "/a")
+		assert.Regexp(t, `^203\.0\.113\.1 - - \[[^\]]+\] "GET /a HTTP/1\.1" 201 5 "-" "test"\n$`, buf.String())
+	})
+	t.Run("template", func(t *testing.T) {
+		s, buf := newServer("{{.RequestID}} {{.Status}} {{.Ingress}}", nil)
+		get(s, "/a")
+		assert.Equal(t, "abc 201 default/example\n", buf.String())
+
+		_, err := NewAccessLogger(buf, "{{.Nope")
+		assert.Error(t, err)
+	})
+	t.Run("per ingress", func(t *testing.T) {
+		s, buf := newServer(AccessLogFormatJSON, map[string]string{AccessLogAnnotation: "false"})
+		get(s, "/a")
+		assert.Empty(t, buf.String(), "disabled ingresses should not be logged")
+
+		s, buf = newServer(AccessLogFormatJSON, map[string]string{AccessLogSampleRateAnnotation: "0"})
+		get(s, "/a")
+		assert.Empty(t, buf.String())
+
+		s, buf = newServer(AccessLogFormatJSON, map[string]string{AccessLogSampleRateAnnotation: "0.5"})
+		for i := 0; i < 200; i++ {
+			get(s, "/a")
+		}
+		lines := strings.Count(buf.String(), "\n")
+		assert.True(t, lines > 50 && lines < 150, "about half the requests should be logged, got %d", lines)
+
+		_, err := parseAccessLog("", "2")
+		assert.Error(t, err)
+	})
+}
+
+func TestResponseRecorder(t *testing.T) {
+	w := &responseRecorder{ResponseWriter: httptest.NewRecorder()}
+	assert.Equal(t, http.StatusOK, w.statusCode())
+	assert.NoError(t, http.NewResponseController(w).Flush())
+	_, _ = w.Write([]byte("abc"))
+	assert.Equal(t, int64(3), w.bytes)
+}
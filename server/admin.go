@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// adminHandler returns the handler for the admin API.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/certificates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.routingTable.Load().(*RoutingTable).certificateStatuses)
+	})
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.routingTable.Load().(*RoutingTable).backendStatuses())
+	})
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.cachePurgeToken == "" {
+			http.Error(w, "cache purging is disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.cachePurgeToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key, prefix := r.FormValue("key"), r.FormValue("prefix")
+		if (key == "") == (prefix == "") {
+			http.Error(w, "exactly one of key or prefix is required", http.StatusBadRequest)
+			return
+		}
+		rt := s.routingTable.Load().(*RoutingTable)
+		writeJSON(w, struct {
+			Purged int `json:"purged"`
+		}{rt.purgeCache(key+prefix, prefix != "")})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to write admin response")
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmin(t *testing.T) {
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := New()
+	s.Update(&watcher.Payload{
+		Certificates: []watcher.CertificateStatus{{
+			Namespace:      "default",
+			Ingress:        "example",
+			SecretName:     "example-tls",
+			Subject:        "CN=www.example.com",
+			Issuer:         "CN=ca",
+			DNSNames:       []string{"www.example.com"},
+			NotAfter:       notAfter,
+			UncoveredHosts: []string{"api.example.com"},
+		}},
+	})
+	h := s.adminHandler()
+
+	t.Run("certificates", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/certificates", nil))
+		assert.Equal(t, 200, w.Code)
+		var statuses []watcher.CertificateStatus
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		if assert.Len(t, statuses, 1) {
+			assert.Equal(t, "example-tls", statuses[0].SecretName)
+			assert.Equal(t, []string{"api.example.com"}, statuses[0].UncoveredHosts)
+		}
+	})
+	t.Run("metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `simple_ingress_certificate_expiry_timestamp_seconds{dns_names="www.example.com",`+
+			`ingress="example",issuer="CN=ca",namespace="default",secret="example-tls",subject="CN=www.example.com"} 1.893553445e+09`)
+		assert.Contains(t, w.Body.String(), `simple_ingress_certificate_uncovered_hosts{ingress="example",namespace="default",secret="example-tls"} 1`)
+	})
+}
+
+func TestAdminServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	adminPort := getFreePort(t)
+	newServer := func(options ...Option) *Server {
+		s := New(append([]Option{
+			WithHost("127.0.0.1"),
+			WithPort(getFreePort(t)),
+			WithTLSPort(getFreePort(t)),
+			WithAdminPort(adminPort),
+		}, options...)...)
+		s.Update(newTestPayload(map[string]string{CacheAnnotation: "true"}))
+		return s
+	}
+	s := newServer(WithCachePurgeToken("secret"))
+	go func() { _ = s.Run(ctx) }()
+	if !waitForPort(ctx, adminPort) {
+		t.Fatalf("admin server never started on %d", adminPort)
+	}
+
+	do := func(method, path, token string) (int, string) {
+		req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://127.0.0.1:%d%s", adminPort, path), nil)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer res.Body.Close()
+		bs, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(bs)
+	}
+
+	t.Run("metrics", func(t *testing.T) {
+		code, body := do("GET", "/metrics", "")
+		assert.Equal(t, http.StatusOK, code, "metrics should be scrapable without a token")
+		assert.Contains(t, body, "simple_ingress_")
+	})
+	t.Run("purge", func(t *testing.T) {
+		code, _ := do("POST", "/cache/purge?prefix=http://www.example.com/", "")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = do("POST", "/cache/purge?prefix=http://www.example.com/", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, body := do("POST", "/cache/purge?prefix=http://www.example.com/", "secret")
+		assert.Equal(t, http.StatusOK, code)
+		assert.JSONEq(t, `{"purged": 0}`, body)
+	})
+	t.Run("purge disabled", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		newServer().adminHandler().ServeHTTP(w, httptest.NewRequest("POST", "/cache/purge?prefix=http://www.example.com/", nil))
+		assert.Equal(t, http.StatusForbidden, w.Code, "purging should be disabled without a token")
+	})
+}
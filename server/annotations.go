@@ -0,0 +1,386 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+)
+
+// The annotations understood by the controller.
+const (
+	BackendProtocolAnnotation     = watcher.AnnotationPrefix + "backend-protocol"
+	AuthTLSSecretAnnotation       = watcher.AnnotationPrefix + "auth-tls-secret"
+	AuthTLSVerifyClientAnnotation = watcher.AnnotationPrefix + "auth-tls-verify-client"
+	AuthBasicSecretAnnotation     = watcher.AnnotationPrefix + "auth-basic-secret"
+	AuthBasicRealmAnnotation      = watcher.AnnotationPrefix + "auth-basic-realm"
+	AuthURLAnnotation             = watcher.AnnotationPrefix + "auth-url"
+	AuthRequestHeadersAnnotation  = watcher.AnnotationPrefix + "auth-request-headers"
+	AuthResponseHeadersAnnotation = watcher.AnnotationPrefix + "auth-response-headers"
+	AuthCacheTTLAnnotation        = watcher.AnnotationPrefix + "auth-cache-ttl"
+	AuthTimeoutAnnotation         = watcher.AnnotationPrefix + "auth-timeout"
+	ProxySSLSecretAnnotation      = watcher.AnnotationPrefix + "proxy-ssl-secret"
+	ProxySSLServerNameAnnotation  = watcher.AnnotationPrefix + "proxy-ssl-server-name"
+	ProxySSLVerifyAnnotation      = watcher.AnnotationPrefix + "proxy-ssl-verify"
+	TLSMinVersionAnnotation       = watcher.AnnotationPrefix + "tls-min-version"
+	TLSMaxVersionAnnotation       = watcher.AnnotationPrefix + "tls-max-version"
+	TLSCipherSuitesAnnotation     = watcher.AnnotationPrefix + "tls-cipher-suites"
+	TLSCurvePreferencesAnnotation = watcher.AnnotationPrefix + "tls-curve-preferences"
+	TLSALPNProtocolsAnnotation    = watcher.AnnotationPrefix + "tls-alpn-protocols"
+
+	ProxyConnectTimeoutAnnotation        = watcher.AnnotationPrefix + "proxy-connect-timeout"
+	ProxyResponseHeaderTimeoutAnnotation = watcher.AnnotationPrefix + "proxy-response-header-timeout"
+	ProxyIdleTimeoutAnnotation           = watcher.AnnotationPrefix + "proxy-idle-timeout"
+	ProxyRequestTimeoutAnnotation        = watcher.AnnotationPrefix + "proxy-request-timeout"
+
+	RetryAttemptsAnnotation      = watcher.AnnotationPrefix + "retry-attempts"
+	RetryOnStatusAnnotation      = watcher.AnnotationPrefix + "retry-on-status"
+	RetryNonIdempotentAnnotation = watcher.AnnotationPrefix + "retry-non-idempotent"
+	RetryBudgetPercentAnnotation = watcher.AnnotationPrefix + "retry-budget-percent"
+
+	OutlierConsecutiveErrorsAnnotation          = watcher.AnnotationPrefix + "outlier-consecutive-errors"
+	OutlierLatencyThresholdAnnotation           = watcher.AnnotationPrefix + "outlier-latency-threshold"
+	OutlierEjectionTimeAnnotation               = watcher.AnnotationPrefix + "outlier-ejection-time"
+	CircuitBreakerMaxRequestsAnnotation         = watcher.AnnotationPrefix + "circuit-breaker-max-requests"
+	CircuitBreakerMaxConnectionsAnnotation      = watcher.AnnotationPrefix + "circuit-breaker-max-connections"
+	CircuitBreakerConsecutiveFailuresAnnotation = watcher.AnnotationPrefix + "circuit-breaker-consecutive-failures"
+	CircuitBreakerOpenTimeAnnotation            = watcher.AnnotationPrefix + "circuit-breaker-open-time"
+
+	HealthCheckPathAnnotation               = watcher.AnnotationPrefix + "health-check-path"
+	HealthCheckIntervalAnnotation           = watcher.AnnotationPrefix + "health-check-interval"
+	HealthCheckTimeoutAnnotation            = watcher.AnnotationPrefix + "health-check-timeout"
+	HealthCheckHealthyThresholdAnnotation   = watcher.AnnotationPrefix + "health-check-healthy-threshold"
+	HealthCheckUnhealthyThresholdAnnotation = watcher.AnnotationPrefix + "health-check-unhealthy-threshold"
+
+	RateLimitAnnotation          = watcher.AnnotationPrefix + "rate-limit"
+	RateLimitBurstAnnotation     = watcher.AnnotationPrefix + "rate-limit-burst"
+	RateLimitKeyAnnotation       = watcher.AnnotationPrefix + "rate-limit-key"
+	RateLimitScopeAnnotation     = watcher.AnnotationPrefix + "rate-limit-scope"
+	RateLimitAllowlistAnnotation = watcher.AnnotationPrefix + "rate-limit-allowlist"
+
+	MaxConcurrentRequestsAnnotation             = watcher.AnnotationPrefix + "max-concurrent-requests"
+	MaxConcurrentRequestsQueueTimeoutAnnotation = watcher.AnnotationPrefix + "max-concurrent-requests-queue-timeout"
+
+	ProxyProtocolAnnotation = watcher.AnnotationPrefix + "proxy-protocol"
+
+	AccessLogAnnotation           = watcher.AnnotationPrefix + "access-log"
+	AccessLogSampleRateAnnotation = watcher.AnnotationPrefix + "access-log-sample-rate"
+
+	CompressionAnnotation          = watcher.AnnotationPrefix + "compression"
+	CompressionEncodingsAnnotation = watcher.AnnotationPrefix + "compression-encodings"
+	CompressionTypesAnnotation     = watcher.AnnotationPrefix + "compression-types"
+	CompressionMinSizeAnnotation   = watcher.AnnotationPrefix + "compression-min-size"
+
+	CacheAnnotation              = watcher.AnnotationPrefix + "cache"
+	CacheMemorySizeAnnotation    = watcher.AnnotationPrefix + "cache-memory-size"
+	CacheDiskSizeAnnotation      = watcher.AnnotationPrefix + "cache-disk-size"
+	CacheMaxObjectSizeAnnotation = watcher.AnnotationPrefix + "cache-max-object-size"
+)
+
+// ingressOptions are the per-ingress settings configured via annotations.
+type ingressOptions struct {
+	backendProtocol string
+	proxyProtocol   string
+	clientAuth      *clientAuth
+	basicAuth       *basicAuth
+	forwardAuth     *forwardAuth
+	upstreamTLS     *tls.Config
+	tlsPolicy       *TLSPolicy
+
+	connectTimeout        time.Duration
+	responseHeaderTimeout time.Duration
+	idleTimeout           time.Duration
+	requestTimeout        time.Duration
+
+	retry   *retryPolicy
+	outlier *outlierDetection
+	breaker *circuitBreaker
+
+	healthCheck *healthCheck
+	rateLimit   *rateLimitOptions
+	concurrency *concurrencyOptions
+	accessLog   *accessLogOptions
+	compression *compressionOptions
+	cache       *cacheOptions
+
+	// fingerprint identifies the annotations and referenced secrets the options were created from.
+	fingerprint string
+}
+
+func parseIngressOptions(ingressPayload watcher.IngressPayload) (*ingressOptions, error) {
+	annotations := ingressPayload.Ingress.Annotations
+	opts := &ingressOptions{
+		backendProtocol: BackendProtocolHTTP,
+		fingerprint:     fingerprint(ingressPayload),
+	}
+
+	if v, ok := annotations[BackendProtocolAnnotation]; ok {
+		opts.backendProtocol = strings.ToLower(v)
+		if !isValidBackendProtocol(opts.backendProtocol) {
+			return nil, fmt.Errorf("%s: unknown backend protocol: %s", BackendProtocolAnnotation, v)
+		}
+	}
+
+	if v, ok := annotations[ProxyProtocolAnnotation]; ok {
+		opts.proxyProtocol = strings.ToLower(v)
+		if opts.proxyProtocol != ProxyProtocolV1 && opts.proxyProtocol != ProxyProtocolV2 {
+			return nil, fmt.Errorf("%s: unknown proxy protocol version: %s", ProxyProtocolAnnotation, v)
+		}
+		if opts.backendProtocol != BackendProtocolHTTP && opts.backendProtocol != BackendProtocolHTTPS {
+			// HTTP/2 connections are shared by many clients, so they can't describe a single client
+			return nil, fmt.Errorf("%s: requires the %s or %s backend protocol", ProxyProtocolAnnotation,
+				BackendProtocolHTTP, BackendProtocolHTTPS)
+		}
+	}
+
+	if isTLSBackendProtocol(opts.backendProtocol) {
+		var secret map[string][]byte
+		if secretName, ok := annotations[ProxySSLSecretAnnotation]; ok {
+			secret, ok = ingressPayload.Secrets[secretName]
+			if !ok {
+				return nil, fmt.Errorf("%s: secret %s not found", ProxySSLSecretAnnotation, secretName)
+			}
+		}
+		var err error
+		opts.upstreamTLS, err = newUpstreamTLSConfig(secret,
+			annotations[ProxySSLServerNameAnnotation], annotations[ProxySSLVerifyAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ProxySSLSecretAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, ProxySSLSecretAnnotation, ProxySSLServerNameAnnotation, ProxySSLVerifyAnnotation) {
+		return nil, fmt.Errorf("the proxy-ssl annotations require the %s or %s backend protocol",
+			BackendProtocolHTTPS, BackendProtocolGRPCS)
+	}
+
+	if secretName, ok := annotations[AuthTLSSecretAnnotation]; ok {
+		ca, err := getSecretValue(ingressPayload, secretName, "ca.crt")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AuthTLSSecretAnnotation, err)
+		}
+		opts.clientAuth, err = newClientAuth(annotations[AuthTLSVerifyClientAnnotation], ca)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AuthTLSVerifyClientAnnotation, err)
+		}
+	}
+
+	if secretName, ok := annotations[AuthBasicSecretAnnotation]; ok {
+		htpasswd, err := getSecretValue(ingressPayload, secretName, BasicAuthSecretKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AuthBasicSecretAnnotation, err)
+		}
+		opts.basicAuth, err = newBasicAuth(annotations[AuthBasicRealmAnnotation], htpasswd)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AuthBasicSecretAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, AuthBasicRealmAnnotation) {
+		return nil, fmt.Errorf("%s requires %s", AuthBasicRealmAnnotation, AuthBasicSecretAnnotation)
+	}
+
+	if v, ok := annotations[AuthURLAnnotation]; ok {
+		var err error
+		opts.forwardAuth, err = parseForwardAuth(
+			v,
+			annotations[AuthRequestHeadersAnnotation],
+			annotations[AuthResponseHeadersAnnotation],
+			annotations[AuthCacheTTLAnnotation],
+			annotations[AuthTimeoutAnnotation],
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", AuthURLAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, AuthRequestHeadersAnnotation, AuthResponseHeadersAnnotation,
+		AuthCacheTTLAnnotation, AuthTimeoutAnnotation) {
+		return nil, fmt.Errorf("the forward auth annotations require %s", AuthURLAnnotation)
+	}
+
+	if hasAnyAnnotation(annotations, TLSMinVersionAnnotation, TLSMaxVersionAnnotation, TLSCipherSuitesAnnotation,
+		TLSCurvePreferencesAnnotation, TLSALPNProtocolsAnnotation) {
+		policy, err := ParseTLSPolicy(
+			annotations[TLSMinVersionAnnotation],
+			annotations[TLSMaxVersionAnnotation],
+			annotations[TLSCipherSuitesAnnotation],
+			annotations[TLSCurvePreferencesAnnotation],
+			annotations[TLSALPNProtocolsAnnotation],
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls policy: %w", err)
+		}
+		opts.tlsPolicy = &policy
+	}
+
+	for annotation, timeout := range map[string]*time.Duration{
+		ProxyConnectTimeoutAnnotation:        &opts.connectTimeout,
+		ProxyResponseHeaderTimeoutAnnotation: &opts.responseHeaderTimeout,
+		ProxyIdleTimeoutAnnotation:           &opts.idleTimeout,
+		ProxyRequestTimeoutAnnotation:        &opts.requestTimeout,
+	} {
+		if v, ok := annotations[annotation]; ok {
+			var err error
+			if *timeout, err = parseDuration(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", annotation, err)
+			}
+		}
+	}
+
+	if v, ok := annotations[RetryAttemptsAnnotation]; ok {
+		var err error
+		opts.retry, err = parseRetryPolicy(v, annotations[RetryOnStatusAnnotation],
+			annotations[RetryNonIdempotentAnnotation], annotations[RetryBudgetPercentAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", RetryAttemptsAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, RetryOnStatusAnnotation, RetryNonIdempotentAnnotation, RetryBudgetPercentAnnotation) {
+		return nil, fmt.Errorf("the retry annotations require %s", RetryAttemptsAnnotation)
+	}
+
+	if v, ok := annotations[OutlierConsecutiveErrorsAnnotation]; ok {
+		var err error
+		opts.outlier, err = parseOutlierDetection(v, annotations[OutlierLatencyThresholdAnnotation],
+			annotations[OutlierEjectionTimeAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", OutlierConsecutiveErrorsAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, OutlierLatencyThresholdAnnotation, OutlierEjectionTimeAnnotation) {
+		return nil, fmt.Errorf("the outlier annotations require %s", OutlierConsecutiveErrorsAnnotation)
+	}
+
+	if hasAnyAnnotation(annotations, CircuitBreakerMaxRequestsAnnotation, CircuitBreakerMaxConnectionsAnnotation,
+		CircuitBreakerConsecutiveFailuresAnnotation, CircuitBreakerOpenTimeAnnotation) {
+		var err error
+		opts.breaker, err = parseCircuitBreaker(annotations[CircuitBreakerMaxRequestsAnnotation],
+			annotations[CircuitBreakerMaxConnectionsAnnotation], annotations[CircuitBreakerConsecutiveFailuresAnnotation],
+			annotations[CircuitBreakerOpenTimeAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker: %w", err)
+		}
+	}
+
+	if v, ok := annotations[HealthCheckPathAnnotation]; ok {
+		var err error
+		opts.healthCheck, err = parseHealthCheck(v, annotations[HealthCheckIntervalAnnotation],
+			annotations[HealthCheckTimeoutAnnotation], annotations[HealthCheckHealthyThresholdAnnotation],
+			annotations[HealthCheckUnhealthyThresholdAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", HealthCheckPathAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, HealthCheckIntervalAnnotation, HealthCheckTimeoutAnnotation,
+		HealthCheckHealthyThresholdAnnotation, HealthCheckUnhealthyThresholdAnnotation) {
+		return nil, fmt.Errorf("the health check annotations require %s", HealthCheckPathAnnotation)
+	}
+
+	if v, ok := annotations[RateLimitAnnotation]; ok {
+		var err error
+		opts.rateLimit, err = parseRateLimit(v, annotations[RateLimitBurstAnnotation], annotations[RateLimitKeyAnnotation],
+			annotations[RateLimitScopeAnnotation], annotations[RateLimitAllowlistAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", RateLimitAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, RateLimitBurstAnnotation, RateLimitKeyAnnotation, RateLimitScopeAnnotation,
+		RateLimitAllowlistAnnotation) {
+		return nil, fmt.Errorf("the rate limit annotations require %s", RateLimitAnnotation)
+	}
+
+	if v, ok := annotations[MaxConcurrentRequestsAnnotation]; ok {
+		var err error
+		opts.concurrency, err = parseConcurrency(v, annotations[MaxConcurrentRequestsQueueTimeoutAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", MaxConcurrentRequestsAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, MaxConcurrentRequestsQueueTimeoutAnnotation) {
+		return nil, fmt.Errorf("%s requires %s", MaxConcurrentRequestsQueueTimeoutAnnotation, MaxConcurrentRequestsAnnotation)
+	}
+
+	if hasAnyAnnotation(annotations, AccessLogAnnotation, AccessLogSampleRateAnnotation) {
+		var err error
+		opts.accessLog, err = parseAccessLog(annotations[AccessLogAnnotation], annotations[AccessLogSampleRateAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log settings: %w", err)
+		}
+	}
+
+	if hasAnyAnnotation(annotations, CompressionAnnotation, CompressionEncodingsAnnotation, CompressionTypesAnnotation,
+		CompressionMinSizeAnnotation) {
+		var err error
+		opts.compression, err = parseCompression(annotations[CompressionAnnotation], annotations[CompressionEncodingsAnnotation],
+			annotations[CompressionTypesAnnotation], annotations[CompressionMinSizeAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression settings: %w", err)
+		}
+	}
+
+	if v, ok := annotations[CacheAnnotation]; ok {
+		var err error
+		opts.cache, err = parseCache(v, annotations[CacheMemorySizeAnnotation], annotations[CacheDiskSizeAnnotation],
+			annotations[CacheMaxObjectSizeAnnotation])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", CacheAnnotation, err)
+		}
+	} else if hasAnyAnnotation(annotations, CacheMemorySizeAnnotation, CacheDiskSizeAnnotation, CacheMaxObjectSizeAnnotation) {
+		return nil, fmt.Errorf("the cache annotations require %s", CacheAnnotation)
+	}
+
+	return opts, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive: %s", s)
+	}
+	return d, nil
+}
+
+// fingerprint returns a hash of the controller's annotations and the secrets they reference.
+func fingerprint(ingressPayload watcher.IngressPayload) string {
+	h := sha256.New()
+	write := func(values ...string) {
+		for _, v := range values {
+			_, _ = fmt.Fprintf(h, "%d:%s", len(v), v)
+		}
+	}
+
+	annotations := ingressPayload.Ingress.Annotations
+	for _, key := range slices.Sorted(maps.Keys(annotations)) {
+		if strings.HasPrefix(key, watcher.AnnotationPrefix) {
+			write(key, annotations[key])
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(ingressPayload.Secrets)) {
+		secret := ingressPayload.Secrets[name]
+		write(name)
+		for _, key := range slices.Sorted(maps.Keys(secret)) {
+			write(key, string(secret[key]))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hasAnyAnnotation(annotations map[string]string, keys ...string) bool {
+	for _, key := range keys {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func getSecretValue(ingressPayload watcher.IngressPayload, secretName, key string) ([]byte, error) {
+	secret, ok := ingressPayload.Secrets[secretName]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", secretName)
+	}
+	value, ok := secret[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no %s", secretName, key)
+	}
+	return value, nil
+}
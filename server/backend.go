@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+)
+
+// The protocols used to talk to a backend.
+const (
+	// BackendProtocolHTTP is plaintext HTTP/1.1.
+	BackendProtocolHTTP = "http"
+	// BackendProtocolH2C is plaintext HTTP/2 with prior knowledge.
+	BackendProtocolH2C = "h2c"
+	// BackendProtocolHTTPS is HTTP/1.1 or HTTP/2 over verified TLS.
+	//
+	// Previously https always spoke HTTP/2 and backends which relied on that keep working, since
+	// HTTP/2 is negotiated via ALPN. Plaintext HTTP/2 backends should use h2c instead, backends
+	// which must only be sent HTTP/2 should use grpcs, and backends with certificates the
+	// controller can't verify need a proxy-ssl-secret with their CA or proxy-ssl-verify: "false".
+	BackendProtocolHTTPS = "https"
+	// BackendProtocolGRPCS is HTTP/2 over verified TLS.
+	BackendProtocolGRPCS = "grpcs"
+)
+
+func isValidBackendProtocol(protocol string) bool {
+	switch protocol {
+	case BackendProtocolHTTP, BackendProtocolH2C, BackendProtocolHTTPS, BackendProtocolGRPCS:
+		return true
+	}
+	return false
+}
+
+func isTLSBackendProtocol(protocol string) bool {
+	return protocol == BackendProtocolHTTPS || protocol == BackendProtocolGRPCS
+}
+
+// backendScheme returns the URL scheme used for the given backend protocol.
+func backendScheme(protocol string) string {
+	if isTLSBackendProtocol(protocol) {
+		return "https"
+	}
+	return "http"
+}
+
+// A backendProxy proxies requests to a backend. Backend proxies are shared by all the paths routing
+// to the same backend and are reused by later routing tables so that connections are pooled.
+type backendProxy struct {
+	key       string
+	namespace string
+	ingress   string
+	url       *url.URL
+	opts      *ingressOptions
+	transport *endpointTransport
+	proxy     *httputil.ReverseProxy
+	breaker   *circuitBreaker
+	stop      context.CancelFunc
+	// startHealthChecks starts the health checks once the backend's endpoints are known.
+	startHealthChecks func()
+}
+
+func newBackendProxy(cfg *config, key string, u *url.URL, opts *ingressOptions) *backendProxy {
+	bp := &backendProxy{
+		key:     key,
+		url:     u,
+		opts:    opts,
+		breaker: opts.breaker.clone(),
+	}
+	bp.transport = newEndpointTransport(newBackendTransport(cfg, u, opts, bp.breaker), u.Host, opts)
+	bp.proxy = httputil.NewSingleHostReverseProxy(u)
+	bp.proxy.Transport = bp.transport
+	if bp.breaker.getState() != "" {
+		bp.proxy.Transport = &breakerTransport{next: bp.transport, breaker: bp.breaker}
+	}
+	bp.proxy.ErrorLog = stdlog.New(log.Logger, "", 0)
+	bp.proxy.ErrorHandler = bp.handleError
+	if opts.healthCheck != nil {
+		var ctx context.Context
+		ctx, bp.stop = context.WithCancel(context.Background())
+		bp.startHealthChecks = sync.OnceFunc(func() {
+			go bp.runHealthChecks(ctx)
+		})
+	}
+	return bp
+}
+
+// ServeHTTP proxies the request to the backend.
+func (bp *backendProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bp.breaker.acquireRequest() {
+		bp.handleError(w, r, fmt.Errorf("%w: too many concurrent requests", errCircuitOpen))
+		return
+	}
+	defer bp.breaker.releaseRequest()
+	if !bp.breaker.allow(time.Now()) {
+		bp.handleError(w, r, errCircuitOpen)
+		return
+	}
+
+	if bp.opts.proxyProtocol != "" {
+		r = r.WithContext(withProxyProtocolAddrs(r))
+	}
+	if bp.opts.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), bp.opts.requestTimeout, errRequestTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	bp.proxy.ServeHTTP(w, r)
+}
+
+func (bp *backendProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if isCircuitOpen(err) {
+		requestLogger(r).Warn().Err(err).
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("backend", bp.url.String()).
+			Msg("upstream unavailable")
+		getRequestInfo(r.Context()).recordUpstreamError("unavailable")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if reason := timeoutReason(r, err); reason != "" {
+		requestLogger(r).Warn().Err(err).
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("backend", bp.url.String()).
+			Str("timeout", reason).
+			Msg("upstream timeout")
+		getRequestInfo(r.Context()).recordUpstreamError("timeout")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+
+	requestLogger(r).Error().Err(err).
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("backend", bp.url.String()).
+		Msg("upstream error")
+	getRequestInfo(r.Context()).recordUpstreamError("error")
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// setEndpoints sets the addresses requests to the backend are sent to.
+func (bp *backendProxy) setEndpoints(endpoints []string) {
+	bp.transport.setEndpoints(endpoints)
+	if bp.startHealthChecks != nil {
+		bp.startHealthChecks()
+	}
+}
+
+// close stops any health checks and closes any idle connections to the backend. In-flight requests
+// are unaffected.
+func (bp *backendProxy) close() {
+	if bp.stop != nil {
+		bp.stop()
+	}
+	bp.transport.CloseIdleConnections()
+}
+
+// newBackendTransport creates the transport used to proxy requests to a backend. New connections are
+// limited by the circuit breaker, if any.
+func newBackendTransport(cfg *config, u *url.URL, opts *ingressOptions, breaker *circuitBreaker) http.RoundTripper {
+	transport := newBackendProtocolTransport(cfg, u, opts, breaker)
+	if opts.responseHeaderTimeout > 0 {
+		transport = &responseHeaderTimeoutTransport{
+			RoundTripper: transport,
+			timeout:      opts.responseHeaderTimeout,
+		}
+	}
+	return transport
+}
+
+func newBackendProtocolTransport(cfg *config, u *url.URL, opts *ingressOptions, breaker *circuitBreaker) http.RoundTripper {
+	protocol, tlsConfig := opts.backendProtocol, opts.upstreamTLS.Clone()
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		// requests are sent to endpoint addresses, so verify the backend using the service name
+		tlsConfig.ServerName = u.Hostname()
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Second * 30,
+		KeepAlive: cfg.backendKeepAlive,
+	}
+	if opts.connectTimeout > 0 {
+		dialer.Timeout = opts.connectTimeout
+	}
+	dial := breaker.limitDial(dialer.DialContext)
+	if opts.proxyProtocol != "" {
+		dial = proxyProtocolDial(dial, opts.proxyProtocol)
+	}
+	idleConnTimeout := cfg.backendIdleConnTimeout
+	if opts.idleTimeout > 0 {
+		idleConnTimeout = opts.idleTimeout
+	}
+
+	switch protocol {
+	case BackendProtocolH2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			IdleConnTimeout: idleConnTimeout,
+		}
+	case BackendProtocolGRPCS:
+		return &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, tlsConfig)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					_ = conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+			TLSClientConfig: tlsConfig,
+			IdleConnTimeout: idleConnTimeout,
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          cfg.backendMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.backendMaxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ExpectContinueTimeout: time.Second,
+	}
+	if protocol == BackendProtocolHTTPS {
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = opts.proxyProtocol == ""
+	}
+	if opts.proxyProtocol != "" {
+		// the PROXY protocol header describes a single client, so connections can't be reused
+		transport.DisableKeepAlives = true
+	}
+	return transport
+}
+
+// newUpstreamTLSConfig creates the TLS configuration used to connect to a backend. The secret may
+// contain a CA bundle (ca.crt) used to verify the backend and a client certificate (tls.crt and
+// tls.key) presented to the backend.
+func newUpstreamTLSConfig(secret map[string][]byte, serverName, verify string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+	}
+
+	if verify != "" {
+		v, err := strconv.ParseBool(verify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verify value: %w", err)
+		}
+		cfg.InsecureSkipVerify = !v
+	}
+
+	if secret == nil {
+		return cfg, nil
+	}
+
+	if ca, ok := secret["ca.crt"]; ok {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no valid CA certificates found")
+		}
+	}
+
+	crt, hasCrt := secret["tls.crt"]
+	key, hasKey := secret["tls.key"]
+	if hasCrt != hasKey {
+		return nil, errors.New("client certificates require both tls.crt and tls.key")
+	}
+	if hasCrt {
+		cert, err := tls.X509KeyPair(crt, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.RootCAs == nil && cfg.Certificates == nil {
+		return nil, errors.New("secret has no ca.crt or tls.crt")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	serverCert := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "backend"},
+		DNSNames:    []string{"backend.default.svc"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCert := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.ServerName+" "+r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*serverCert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cfg *tls.Config) (string, error) {
+		u, _ := url.Parse(srv.URL)
+		transport := newBackendTransport(defaultConfig(), u, &ingressOptions{
+			backendProtocol: BackendProtocolHTTPS,
+			upstreamTLS:     cfg,
+		}, nil)
+		res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		bs, err := io.ReadAll(res.Body)
+		return string(bs), err
+	}
+
+	t.Run("verified with client certificate", func(t *testing.T) {
+		cfg, err := newUpstreamTLSConfig(map[string][]byte{
+			"ca.crt":  ca.pem,
+			"tls.crt": clientCert.pem,
+			"tls.key": clientCert.keyPEM(t),
+		}, "backend.default.svc", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, err := get(cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "backend.default.svc proxy", body)
+	})
+	t.Run("unknown ca", func(t *testing.T) {
+		cfg, err := newUpstreamTLSConfig(nil, "", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = get(cfg)
+		assert.Error(t, err)
+	})
+	t.Run("no client certificate", func(t *testing.T) {
+		cfg, err := newUpstreamTLSConfig(map[string][]byte{"ca.crt": ca.pem}, "", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = get(cfg)
+		assert.Error(t, err)
+	})
+	t.Run("invalid secrets", func(t *testing.T) {
+		_, err := newUpstreamTLSConfig(map[string][]byte{"tls.crt": clientCert.pem}, "", "")
+		assert.Error(t, err)
+		_, err = newUpstreamTLSConfig(map[string][]byte{"ca.crt": []byte("invalid")}, "", "")
+		assert.Error(t, err)
+		_, err = newUpstreamTLSConfig(nil, "", "maybe")
+		assert.Error(t, err)
+	})
+}
+
+func TestHTTPSBackendProtocol(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg, err := newUpstreamTLSConfig(nil, "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	cfg.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	u, _ := url.Parse(srv.URL)
+	transport := newBackendTransport(defaultConfig(), u, &ingressOptions{
+		backendProtocol: BackendProtocolHTTPS,
+		upstreamTLS:     cfg,
+	}, nil)
+	res, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	bs, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", string(bs), "https backends which support HTTP/2 should still be sent HTTP/2")
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BasicAuthSecretKey is the key in basic auth secrets holding the htpasswd file.
+const BasicAuthSecretKey = "auth"
+
+// defaultBasicAuthRealm is the realm used when an ingress doesn't set one.
+const defaultBasicAuthRealm = "Authentication Required"
+
+// maxVerifiedCredentials limits how many verified credentials are remembered to avoid repeating
+// expensive bcrypt comparisons.
+const maxVerifiedCredentials = 1024
+
+// basicAuth holds the HTTP basic authentication settings of an ingress.
+type basicAuth struct {
+	realm string
+	users map[string]string
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// newBasicAuth creates a basicAuth from an htpasswd file. Passwords may be hashed with bcrypt,
+// SHA1 ({SHA}) or Apache's MD5 ($apr1$).
+func newBasicAuth(realm string, htpasswd []byte) (*basicAuth, error) {
+	if realm == "" {
+		realm = defaultBasicAuthRealm
+	}
+	if strings.ContainsAny(realm, "\"\\\r\n") {
+		return nil, fmt.Errorf("invalid realm: %q", realm)
+	}
+
+	ba := &basicAuth{
+		realm:    realm,
+		users:    make(map[string]string),
+		verified: make(map[[sha256.Size]byte]bool),
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(htpasswd))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:password", line)
+		}
+		if !isSupportedPasswordHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported password hash for %s, expected bcrypt, SHA1 or apr1", line, user)
+		}
+		ba.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ba.users) == 0 {
+		return nil, errors.New("no users found")
+	}
+	return ba, nil
+}
+
+// authorize checks a request's credentials, responding with 401 Unauthorized if they're missing or
+// invalid.
+func (ba *basicAuth) authorize(w http.ResponseWriter, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if ok && ba.verify(user, password) {
+		return true
+	}
+	if ok {
+		requestLogger(r).Info().Str("host", r.Host).Str("user", user).Msg("basic auth rejected")
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+ba.realm+`", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func (ba *basicAuth) verify(user, password string) bool {
+	hash, ok := ba.users[user]
+	if !ok {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	ba.mu.Lock()
+	verified := ba.verified[key]
+	ba.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if !verifyPasswordHash(hash, password) {
+		return false
+	}
+	ba.mu.Lock()
+	if len(ba.verified) >= maxVerifiedCredentials {
+		clear(ba.verified)
+	}
+	ba.verified[key] = true
+	ba.mu.Unlock()
+	return true
+}
+
+func isSupportedPasswordHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		_, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):])
+		return err == nil
+	case strings.HasPrefix(hash, apr1Magic):
+		_, _, ok := strings.Cut(hash[len(apr1Magic):], "$")
+		return ok
+	}
+	return false
+}
+
+func verifyPasswordHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	case strings.HasPrefix(hash, apr1Magic):
+		salt, _, _ := strings.Cut(hash[len(apr1Magic):], "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+const apr1Magic = "$apr1$"
+
+// apr1 hashes a password with Apache's variant of the MD5-based crypt algorithm.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Magic))
+	h.Write([]byte(salt))
+
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= md5.Size {
+		h.Write(alt[:min(i, md5.Size)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(sum)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(sum)
+		} else {
+			round.Write(pw)
+		}
+		sum = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var b strings.Builder
+	b.WriteString(apr1Magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			b.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[g[0]])<<16|uint32(sum[g[1]])<<8|uint32(sum[g[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return b.String()
+}
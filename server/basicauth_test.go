@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secret"))
+	}))
+	defer backend.Close()
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-password"), bcrypt.MinCost)
+	if !assert.NoError(t, err) {
+		return
+	}
+	htpasswd := "# users\n" +
+		"alice:" + string(bcryptHash) + "\n" +
+		"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n" + // password
+		"carol:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" // myPassword
+
+	newServer := func(annotations map[string]string) *Server {
+		payload := newTestPayload(annotations, hostOf(backend))
+		payload.Ingresses[0].Secrets = map[string]map[string][]byte{
+			"htpasswd": {BasicAuthSecretKey: []byte(htpasswd)},
+		}
+		s := New()
+		s.Update(payload)
+		return s
+	}
+	get := func(s *Server, user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+		if user != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	s := newServer(map[string]string{AuthBasicSecretAnnotation: "htpasswd", AuthBasicRealmAnnotation: "dashboard"})
+	for _, tc := range []struct {
+		user, password string
+		expect         int
+	}{
+		{"alice", "bcrypt-password", http.StatusOK},
+		{"alice", "bcrypt-password", http.StatusOK},
+		{"bob", "password", http.StatusOK},
+		{"carol", "myPassword", http.StatusOK},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"carol", "mypassword", http.StatusUnauthorized},
+		{"dave", "password", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		w := get(s, tc.user, tc.password)
+		assert.Equal(t, tc.expect, w.Code, "%s:%s", tc.user, tc.password)
+		if tc.expect == http.StatusUnauthorized {
+			assert.Equal(t, `Basic realm="dashboard", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+		} else {
+			assert.Equal(t, "secret", w.Body.String())
+		}
+	}
+}
+
+func TestNewBasicAuth(t *testing.T) {
+	_, err := newBasicAuth("", []byte("alice:plaintext\n"))
+	assert.Error(t, err, "plaintext passwords should be rejected")
+	_, err = newBasicAuth("", []byte("alice:$1$salt$hash\n"))
+	assert.Error(t, err, "md5-crypt passwords should be rejected")
+	_, err = newBasicAuth("", []byte("\n# nobody\n"))
+	assert.Error(t, err)
+	_, err = newBasicAuth(`"quoted"`, []byte("alice:$apr1$abcdefgh$kOJTMCvat3K9n.uiGZK.J1"))
+	assert.Error(t, err, "realms with quotes should be rejected")
+
+	ba, err := newBasicAuth("", []byte("alice:$apr1$abcdefgh$kOJTMCvat3K9n.uiGZK.J1"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, defaultBasicAuthRealm, ba.realm)
+		assert.True(t, ba.verify("alice", "p@ss wörd"))
+	}
+}
@@ -0,0 +1,910 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The X-Cache-Status values of responses passing through a cache.
+const (
+	cacheStatusHit         = "HIT"
+	cacheStatusMiss        = "MISS"
+	cacheStatusStale       = "STALE"
+	cacheStatusRevalidated = "REVALIDATED"
+)
+
+// cacheOptions are the per-ingress response cache settings.
+type cacheOptions struct {
+	memorySize    int64
+	diskSize      int64
+	maxObjectSize int64
+}
+
+func parseCache(enabled, memorySize, diskSize, maxObjectSize string) (*cacheOptions, error) {
+	if v, err := strconv.ParseBool(enabled); err != nil {
+		return nil, fmt.Errorf("invalid cache: %s", enabled)
+	} else if !v {
+		return nil, nil
+	}
+
+	opts := &cacheOptions{
+		memorySize:    64 << 20,
+		maxObjectSize: 8 << 20,
+	}
+	for _, size := range []struct {
+		value string
+		dst   *int64
+	}{
+		{memorySize, &opts.memorySize},
+		{diskSize, &opts.diskSize},
+		{maxObjectSize, &opts.maxObjectSize},
+	} {
+		if size.value == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(size.value)
+		if err != nil || q.Sign() < 0 {
+			return nil, fmt.Errorf("invalid size: %s", size.value)
+		}
+		*size.dst = q.Value()
+	}
+	return opts, nil
+}
+
+// A responseCache is a shared HTTP cache (RFC 9111) of an ingress's responses. Entries are kept in
+// memory, and when a directory is given, spilled to disk when they're evicted from memory.
+type responseCache struct {
+	opts *cacheOptions
+	dir  string
+	// requestIDHeader is never served from the cache, so responses keep their own request IDs.
+	requestIDHeader string
+
+	mu         sync.Mutex
+	entries    map[string][]*cacheEntry
+	memory     *list.List
+	memorySize int64
+	disk       *list.List
+	diskSize   int64
+	files      uint64
+	inflight   map[string]chan struct{}
+}
+
+func newResponseCache(opts *cacheOptions, dir, requestIDHeader string) *responseCache {
+	if dir != "" {
+		// remove anything left behind by a previous process
+		_ = os.RemoveAll(dir)
+	}
+	return &responseCache{
+		opts:            opts,
+		dir:             dir,
+		requestIDHeader: http.CanonicalHeaderKey(requestIDHeader),
+		entries:         make(map[string][]*cacheEntry),
+		memory:          list.New(),
+		disk:            list.New(),
+		inflight:        make(map[string]chan struct{}),
+	}
+}
+
+// A cacheEntry is a stored response. Apart from where its body is kept, an entry isn't modified once
+// stored; revalidated responses are stored as new entries.
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	// vary are the values of the request headers named by the response's Vary header.
+	vary map[string]string
+	cc   cacheControl
+
+	requestTime, responseTime time.Time
+	initialAge, lifetime      time.Duration
+
+	// body is nil when the entry has been spilled to disk at path. While spilling is set, the entry
+	// is being written to path and is in neither the memory nor the disk list.
+	body     []byte
+	path     string
+	size     int64
+	elem     *list.Element
+	spilling bool
+
+	revalidating bool
+}
+
+func newCacheEntry(key string, r *http.Request, status int, header http.Header, body []byte, requestTime, responseTime time.Time) *cacheEntry {
+	e := &cacheEntry{
+		key:          key,
+		status:       status,
+		header:       header,
+		vary:         make(map[string]string),
+		cc:           parseCacheControl(header.Values("Cache-Control")),
+		requestTime:  requestTime,
+		responseTime: responseTime,
+		body:         body,
+		size:         int64(len(body)),
+	}
+	for _, name := range varyFields(header) {
+		e.vary[name] = strings.Join(r.Header.Values(name), ", ")
+	}
+	for k, vs := range header {
+		e.size += int64(len(k))
+		for _, v := range vs {
+			e.size += int64(len(v))
+		}
+	}
+
+	// RFC 9111 section 4.2.3
+	date := e.date()
+	apparentAge := max(0, responseTime.Sub(date))
+	ageValue, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+	correctedAgeValue := time.Duration(ageValue)*time.Second + responseTime.Sub(requestTime)
+	e.initialAge = max(apparentAge, correctedAgeValue)
+
+	// RFC 9111 section 4.2.1
+	if d, ok := e.cc.seconds("s-maxage"); ok {
+		e.lifetime = d
+	} else if d, ok := e.cc.seconds("max-age"); ok {
+		e.lifetime = d
+	} else if v := header.Get("Expires"); v != "" {
+		// invalid dates are in the past
+		if expires, err := http.ParseTime(v); err == nil {
+			e.lifetime = max(0, expires.Sub(date))
+		}
+	} else if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && heuristicallyCacheable[status] {
+		// RFC 9111 section 4.2.2
+		e.lifetime = min(date.Sub(lastModified)/10, time.Hour*24)
+	}
+	return e
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.header.Get("Date")); err == nil {
+		return date
+	}
+	return e.responseTime
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseTime)
+}
+
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if strings.Join(r.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) mustRevalidate() bool {
+	return e.cc.has("must-revalidate") || e.cc.has("proxy-revalidate") || e.cc.has("s-maxage")
+}
+
+type cacheFreshness int
+
+const (
+	cacheEntryStale cacheFreshness = iota
+	cacheEntryFresh
+	cacheEntryStaleWhileRevalidate
+)
+
+// freshness returns whether the entry can be used to respond to a request with the given cache
+// directives.
+func (e *cacheEntry) freshness(reqCC cacheControl, now time.Time) cacheFreshness {
+	if e.cc.has("no-cache") || reqCC.has("no-cache") {
+		return cacheEntryStale
+	}
+	age, lifetime := e.age(now), e.lifetime
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return cacheEntryStale
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		lifetime -= d
+	}
+	if lifetime > age {
+		return cacheEntryFresh
+	}
+
+	staleness := age - lifetime
+	if e.mustRevalidate() {
+		return cacheEntryStale
+	}
+	if v, ok := reqCC["max-stale"]; ok {
+		if d, err := strconv.ParseInt(v, 10, 64); v == "" || (err == nil && staleness <= time.Duration(d)*time.Second) {
+			return cacheEntryFresh
+		}
+	}
+	if d, ok := e.cc.seconds("stale-while-revalidate"); ok && staleness <= d {
+		return cacheEntryStaleWhileRevalidate
+	}
+	return cacheEntryStale
+}
+
+// usableOnError returns whether the entry can be used when revalidating it fails (RFC 5861).
+func (e *cacheEntry) usableOnError(now time.Time) bool {
+	d, ok := e.cc.seconds("stale-if-error")
+	return ok && !e.mustRevalidate() && e.age(now)-e.lifetime <= d
+}
+
+// serve serves a request from the cache, sending it to next when there's no usable stored response.
+func (c *responseCache) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	key := cacheKey(r)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		next.ServeHTTP(w, r)
+		return
+	default:
+		// RFC 9111 section 4.4
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.statusCode() < 400 {
+			c.purge(key, false)
+		}
+		return
+	}
+	if r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	reqCC := parseCacheControl(r.Header.Values("Cache-Control"))
+	if len(reqCC) == 0 && r.Header.Get("Pragma") == "no-cache" {
+		reqCC["no-cache"] = ""
+	}
+
+	for waited := false; ; waited = true {
+		now := time.Now()
+		e, body := c.lookup(key, r)
+		if e != nil {
+			switch e.freshness(reqCC, now) {
+			case cacheEntryFresh:
+				c.write(w, r, e, body, now, cacheStatusHit)
+				return
+			case cacheEntryStaleWhileRevalidate:
+				c.revalidateInBackground(r, e, body, next)
+				c.write(w, r, e, body, now, cacheStatusStale)
+				return
+			}
+		}
+		if reqCC.has("only-if-cached") {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+
+		// collapse concurrent misses: wait for the request in flight and then look again
+		done, leader := c.join(key)
+		if !leader && !waited {
+			select {
+			case <-done:
+				continue
+			case <-r.Context().Done():
+				return
+			}
+		}
+		var release func()
+		if leader {
+			release = sync.OnceFunc(func() { c.leave(key, done) })
+			defer release()
+		}
+		c.fetch(w, r, next, key, e, body, reqCC, release)
+		return
+	}
+}
+
+// fetch sends a request to the backend, revalidating the stale entry if there is one, and stores
+// the response if it can be. release, if set, is called as soon as the response turns out not to be
+// storable, so collapsed requests waiting for it are sent to the backend without waiting for the body.
+func (c *responseCache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, stale *cacheEntry, staleBody []byte, reqCC cacheControl, release func()) {
+	out := r
+	conditional, staleIfError := false, false
+	if stale != nil {
+		if r.Method == http.MethodGet && !hasConditionals(r.Header) {
+			out = r.Clone(r.Context())
+			if etag := stale.header.Get("ETag"); etag != "" {
+				out.Header.Set("If-None-Match", etag)
+				conditional = true
+			}
+			if lastModified := stale.header.Get("Last-Modified"); lastModified != "" {
+				out.Header.Set("If-Modified-Since", lastModified)
+				conditional = true
+			}
+		}
+		staleIfError = stale.usableOnError(time.Now())
+	}
+
+	cw := &cacheWriter{
+		ResponseWriter: w,
+		header:         make(http.Header),
+		maxSize:        c.opts.maxObjectSize,
+		intercept: func(status int) bool {
+			return (conditional && status == http.StatusNotModified) || (staleIfError && status >= 500)
+		},
+		storable: func(status int, header http.Header) bool {
+			return r.Method == http.MethodGet && isStorable(r, reqCC, status, header)
+		},
+		release: release,
+	}
+	requestTime := time.Now()
+	next.ServeHTTP(cw, out)
+	responseTime := time.Now()
+
+	switch {
+	case cw.intercepted && cw.status == http.StatusNotModified:
+		// RFC 9111 section 4.3.4
+		header := stale.header.Clone()
+		for k, vs := range cw.header {
+			if k != "Content-Length" {
+				header[k] = vs
+			}
+		}
+		e := newCacheEntry(key, r, stale.status, header, staleBody, requestTime, responseTime)
+		c.store(e, stale)
+		c.write(w, r, e, staleBody, responseTime, cacheStatusRevalidated)
+	case cw.intercepted:
+		c.write(w, r, stale, staleBody, responseTime, cacheStatusStale)
+	default:
+		cw.finish()
+		if cw.buffering {
+			c.store(newCacheEntry(key, r, cw.status, cw.header.Clone(), cw.body.Bytes(), requestTime, responseTime), stale)
+		}
+	}
+}
+
+// revalidateInBackground revalidates a stale entry without making the client wait.
+func (c *responseCache) revalidateInBackground(r *http.Request, e *cacheEntry, body []byte, next http.Handler) {
+	c.mu.Lock()
+	if e.revalidating {
+		c.mu.Unlock()
+		return
+	}
+	e.revalidating = true
+	c.mu.Unlock()
+
+	// the request outlives the client's, so it mustn't be canceled with it or update its information
+	ctx := context.WithValue(context.WithoutCancel(r.Context()), requestInfoContextKey{}, (*requestInfo)(nil))
+	out := r.Clone(ctx)
+	out.Method = http.MethodGet
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "Cache-Control", "Pragma"} {
+		out.Header.Del(name)
+	}
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			e.revalidating = false
+			c.mu.Unlock()
+		}()
+		c.fetch(newDiscardResponseWriter(), out, next, e.key, e, body, cacheControl{}, nil)
+	}()
+}
+
+// write responds with a stored response.
+func (c *responseCache) write(w http.ResponseWriter, r *http.Request, e *cacheEntry, body []byte, now time.Time, status string) {
+	h := w.Header()
+	age := strconv.FormatInt(int64(e.age(now)/time.Second), 10)
+	if e.status == http.StatusOK && isNotModified(r.Header, e.header) {
+		for _, k := range []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"} {
+			if vs, ok := e.header[k]; ok {
+				h[k] = append([]string(nil), vs...)
+			}
+		}
+		h.Set("Age", age)
+		h.Set("X-Cache-Status", status)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	hopByHop := connectionHeaders(e.header)
+	for k, vs := range e.header {
+		if k == c.requestIDHeader || hopByHop[k] {
+			continue
+		}
+		h[k] = append([]string(nil), vs...)
+	}
+	h.Set("Age", age)
+	h.Set("X-Cache-Status", status)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// lookup returns the stored response matching a request and its body.
+func (c *responseCache) lookup(key string, r *http.Request) (*cacheEntry, []byte) {
+	c.mu.Lock()
+	var e *cacheEntry
+	for _, variant := range c.entries[key] {
+		if variant.matches(r) {
+			e = variant
+			break
+		}
+	}
+	if e == nil {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if e.body != nil {
+		c.memory.MoveToFront(e.elem)
+		c.mu.Unlock()
+		return e, e.body
+	}
+	c.disk.MoveToFront(e.elem)
+	path := e.path
+	c.mu.Unlock()
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		log.Error().Err(err).Str("key", key).Msg("failed to read cached response")
+		c.mu.Lock()
+		c.remove(e)
+		c.mu.Unlock()
+		return nil, nil
+	}
+	return e, body
+}
+
+// store stores an entry, replacing the previous entry for the same variant if there is one.
+func (c *responseCache) store(e, prev *cacheEntry) {
+	c.mu.Lock()
+
+	if prev != nil {
+		c.remove(prev)
+	}
+	for _, variant := range c.entries[e.key] {
+		if equalVary(variant.vary, e.vary) {
+			c.remove(variant)
+			break
+		}
+	}
+	c.entries[e.key] = append(c.entries[e.key], e)
+	e.elem = c.memory.PushFront(e)
+	c.memorySize += e.size
+	spill := c.evict()
+	c.mu.Unlock()
+
+	for _, e := range spill {
+		c.spill(e)
+	}
+}
+
+// evict removes the least recently used entries from memory until the cache fits in its limits. It
+// returns the entries to write to disk, which are still served from memory until they're spilled.
+func (c *responseCache) evict() []*cacheEntry {
+	var spill []*cacheEntry
+	for c.memorySize > c.opts.memorySize {
+		e := c.memory.Back().Value.(*cacheEntry)
+		if c.dir == "" || e.size > c.opts.diskSize {
+			c.remove(e)
+			continue
+		}
+		c.memory.Remove(e.elem)
+		c.memorySize -= e.size
+		c.files++
+		e.path = filepath.Join(c.dir, strconv.FormatUint(c.files, 10))
+		e.spilling = true
+		spill = append(spill, e)
+	}
+	for c.diskSize > c.opts.diskSize {
+		c.remove(c.disk.Back().Value.(*cacheEntry))
+	}
+	return spill
+}
+
+// spill writes an evicted entry to disk and moves it to the disk list. The file is written without
+// holding the lock.
+func (c *responseCache) spill(e *cacheEntry) {
+	err := os.MkdirAll(c.dir, 0700)
+	if err == nil {
+		err = os.WriteFile(e.path, e.body, 0600)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Str("key", e.key).Msg("failed to write cached response to disk")
+		c.remove(e)
+		_ = os.Remove(e.path)
+		return
+	}
+	if !c.contains(e) {
+		// the entry was replaced or purged while it was written
+		_ = os.Remove(e.path)
+		return
+	}
+	e.spilling = false
+	e.body = nil
+	e.elem = c.disk.PushFront(e)
+	c.diskSize += e.size
+	for c.diskSize > c.opts.diskSize {
+		c.remove(c.disk.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *responseCache) contains(e *cacheEntry) bool {
+	for _, variant := range c.entries[e.key] {
+		if variant == e {
+			return true
+		}
+	}
+	return false
+}
+
+// remove removes an entry from the cache. It does nothing if the entry has already been removed.
+func (c *responseCache) remove(e *cacheEntry) {
+	variants := c.entries[e.key]
+	i := 0
+	for i < len(variants) && variants[i] != e {
+		i++
+	}
+	if i == len(variants) {
+		return
+	}
+	if len(variants) == 1 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = append(variants[:i:i], variants[i+1:]...)
+	}
+
+	switch {
+	case e.spilling:
+		// spill removes the file once it has been written
+	case e.body != nil:
+		c.memory.Remove(e.elem)
+		c.memorySize -= e.size
+	default:
+		c.disk.Remove(e.elem)
+		c.diskSize -= e.size
+		_ = os.Remove(e.path)
+	}
+}
+
+// purge removes the entries with the given key, or with keys starting with it if prefix is set. It
+// returns the number of removed entries.
+func (c *responseCache) purge(key string, prefix bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for k, variants := range c.entries {
+		if k == key || (prefix && strings.HasPrefix(k, key)) {
+			for _, e := range variants {
+				c.remove(e)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// join joins the request in flight for a key, or starts one if there is none.
+func (c *responseCache) join(key string) (done chan struct{}, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.inflight[key]; ok {
+		return done, false
+	}
+	done = make(chan struct{})
+	c.inflight[key] = done
+	return done, true
+}
+
+func (c *responseCache) leave(key string, done chan struct{}) {
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(done)
+}
+
+// close removes the cache's files.
+func (c *responseCache) close() {
+	if c.dir != "" {
+		_ = os.RemoveAll(c.dir)
+	}
+}
+
+// cacheKey returns the key of the responses to a request: its scheme, host and port followed by the
+// request URI, like https://www.example.com:8443/a?b. Default ports are left out.
+func cacheKey(r *http.Request) string {
+	// the header has been set from the connection unless the request came from a trusted proxy
+	scheme := r.Header.Get(headerXForwardedProto)
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host := strings.ToLower(r.Host)
+	switch scheme {
+	case "http":
+		host = strings.TrimSuffix(host, ":80")
+	case "https":
+		host = strings.TrimSuffix(host, ":443")
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// heuristicallyCacheable are the status codes of responses which may be cached without explicit
+// freshness information (RFC 9110 section 15.1).
+var heuristicallyCacheable = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// isStorable returns whether a response may be stored by a shared cache (RFC 9111 section 3).
+func isStorable(r *http.Request, reqCC cacheControl, status int, h http.Header) bool {
+	if status < 200 || status == http.StatusPartialContent {
+		return false
+	}
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	switch {
+	case reqCC.has("no-store"), cc.has("no-store"), cc.has("private"):
+		return false
+	case r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	case h.Get("Set-Cookie") != "", h.Get("Trailer") != "":
+		// cookies are meant for a single client
+		return false
+	}
+	for _, name := range varyFields(h) {
+		if name == "*" {
+			return false
+		}
+	}
+
+	explicit := cc.has("max-age") || cc.has("s-maxage") || h.Get("Expires") != ""
+	if !explicit && !cc.has("public") && !heuristicallyCacheable[status] {
+		return false
+	}
+	// responses which are never fresh are only worth storing if they can be revalidated
+	return explicit || h.Get("Last-Modified") != "" || h.Get("ETag") != ""
+}
+
+func varyFields(h http.Header) []string {
+	var fields []string
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+func equalVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func hasConditionals(h http.Header) bool {
+	return h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" ||
+		h.Get("If-Match") != "" || h.Get("If-Unmodified-Since") != "" || h.Get("If-Range") != ""
+}
+
+// isNotModified evaluates a request's If-None-Match and If-Modified-Since preconditions against a
+// stored response's validators (RFC 9110 section 13.1).
+func isNotModified(reqHeader, header http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			if v = strings.TrimSpace(v); v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// cacheControl are the directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range values {
+		for _, directive := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	v, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// A cacheWriter passes a response to the client, buffering it to be stored if storable returns true
+// for its status and header. Responses for which intercept returns true aren't passed to the client.
+type cacheWriter struct {
+	http.ResponseWriter
+	header    http.Header
+	maxSize   int64
+	intercept func(status int) bool
+	storable  func(status int, header http.Header) bool
+	// release, if set, is called once the response turns out not to be storable or too large.
+	release func()
+
+	status      int
+	wroteHeader bool
+	intercepted bool
+	// buffering is false once the response turns out not to be storable or too large.
+	buffering bool
+	body      bytes.Buffer
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status < 200 {
+		copyHeader(cw.ResponseWriter.Header(), cw.header)
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if cw.intercept(status) {
+		cw.intercepted = true
+		return
+	}
+	cw.buffering = cw.storable(status, cw.header)
+	if n, err := strconv.ParseInt(cw.header.Get("Content-Length"), 10, 64); err == nil && n > cw.maxSize {
+		cw.buffering = false
+	}
+	if !cw.buffering && cw.release != nil {
+		cw.release()
+	}
+	h := cw.ResponseWriter.Header()
+	copyHeader(h, cw.header)
+	h.Set("X-Cache-Status", cacheStatusMiss)
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted {
+		return len(p), nil
+	}
+	if cw.buffering {
+		if int64(cw.body.Len()+len(p)) > cw.maxSize {
+			cw.buffering = false
+			cw.body = bytes.Buffer{}
+			if cw.release != nil {
+				cw.release()
+			}
+		} else {
+			cw.body.Write(p)
+		}
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted {
+		return
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// finish passes any trailers to the client.
+func (cw *cacheWriter) finish() {
+	if !cw.wroteHeader {
+		copyHeader(cw.ResponseWriter.Header(), cw.header)
+		cw.status = http.StatusOK
+		cw.buffering = cw.storable(cw.status, cw.header)
+		return
+	}
+	h := cw.ResponseWriter.Header()
+	for _, v := range cw.header.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			if k = http.CanonicalHeaderKey(strings.TrimSpace(k)); k != "" {
+				h[k] = cw.header[k]
+			}
+		}
+	}
+	for k, vs := range cw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			h[k] = vs
+		}
+	}
+}
+
+// hopByHopHeaders are the headers which only apply to a single connection (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// connectionHeaders returns the hop-by-hop headers, including the ones listed in the Connection header.
+func connectionHeaders(h http.Header) map[string]bool {
+	names := make(map[string]bool, len(hopByHopHeaders))
+	for _, name := range hopByHopHeaders {
+		names[name] = true
+	}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vs := range src {
+		dst[k] = vs
+	}
+}
+
+// A discardResponseWriter is a response writer for requests without a client.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
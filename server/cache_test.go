@@ -0,0 +1,391 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	var requests atomic.Int64
+	var lastHeaders atomic.Value
+	release, stream := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		lastHeaders.Store(r.Header.Clone())
+		q := r.URL.Query()
+		if v := q.Get("cache-control"); v != "" {
+			w.Header().Set("Cache-Control", v)
+		}
+		if v := q.Get("vary"); v != "" {
+			w.Header().Set("Vary", v)
+		}
+		if q.Get("cookie") != "" {
+			w.Header().Set("Set-Cookie", "a=b")
+		}
+		if q.Get("block") != "" {
+			<-release
+		}
+		if q.Get("stream") != "" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-stream
+			return
+		}
+		if q.Get("fail") != "" && requests.Load() > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if q.Get("etag") != "" {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(r.Header.Get("Accept-Language") + strings.Repeat("x", 2048)))
+	}))
+	defer backend.Close()
+
+	newServer := func(annotations map[string]string, options ...Option) *Server {
+		requests.Store(0)
+		if annotations == nil {
+			annotations = map[string]string{CacheAnnotation: "true"}
+		}
+		s := New(options...)
+		s.Update(newTestPayload(annotations, hostOf(backend)))
+		return s
+	}
+	do := func(s *Server, method, path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://www.example.com"+path, nil)
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	get := func(s *Server, path string) *httptest.ResponseRecorder {
+		return do(s, "GET", path, nil)
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		s := newServer(nil)
+		w := get(s, "/a?cache-control=max-age=60")
+		assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"))
+		w = get(s, "/a?cache-control=max-age=60")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, cacheStatusHit, w.Header().Get("X-Cache-Status"))
+		assert.Equal(t, "0", w.Header().Get("Age"))
+		assert.Len(t, w.Body.String(), 2048)
+		w = do(s, "HEAD", "/a?cache-control=max-age=60", nil)
+		assert.Equal(t, cacheStatusHit, w.Header().Get("X-Cache-Status"))
+		assert.Empty(t, w.Body.String())
+		assert.Equal(t, int64(1), requests.Load())
+
+		w = do(s, "GET", "/a?cache-control=max-age=60", http.Header{"Cache-Control": {"no-cache"}})
+		assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"), "clients should be able to skip the cache")
+		assert.Equal(t, int64(2), requests.Load())
+	})
+	t.Run("not storable", func(t *testing.T) {
+		s := newServer(nil)
+		for _, path := range []string{
+			"/a",
+			"/a?cache-control=no-store",
+			"/a?cache-control=private,max-age=60",
+			"/a?cache-control=max-age=60&cookie=1",
+			"/a?cache-control=max-age=60&vary=*",
+		} {
+			get(s, path)
+			w := get(s, path)
+			assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"), path)
+		}
+		do(s, "GET", "/a?cache-control=max-age=60", http.Header{"Authorization": {"Bearer x"}})
+		w := do(s, "GET", "/a?cache-control=max-age=60", http.Header{"Authorization": {"Bearer x"}})
+		assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"), "authorized responses should not be shared")
+	})
+	t.Run("vary", func(t *testing.T) {
+		s := newServer(nil)
+		path := "/a?cache-control=max-age=60&vary=Accept-Language"
+		en, fr := http.Header{"Accept-Language": {"en"}}, http.Header{"Accept-Language": {"fr"}}
+		do(s, "GET", path, en)
+		do(s, "GET", path, fr)
+		w := do(s, "GET", path, en)
+		assert.Equal(t, cacheStatusHit, w.Header().Get("X-Cache-Status"))
+		assert.True(t, strings.HasPrefix(w.Body.String(), "enx"))
+		w = do(s, "GET", path, fr)
+		assert.Equal(t, cacheStatusHit, w.Header().Get("X-Cache-Status"))
+		assert.True(t, strings.HasPrefix(w.Body.String(), "frx"))
+		assert.Equal(t, int64(2), requests.Load())
+	})
+	t.Run("revalidation", func(t *testing.T) {
+		s := newServer(nil)
+		path := "/a?cache-control=max-age=0&etag=1"
+		get(s, path)
+		w := get(s, path)
+		assert.Equal(t, `"v1"`, lastHeaders.Load().(http.Header).Get("If-None-Match"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, cacheStatusRevalidated, w.Header().Get("X-Cache-Status"))
+		assert.Len(t, w.Body.String(), 2048)
+		assert.Equal(t, int64(2), requests.Load())
+
+		do(s, "GET", "/a?cache-control=max-age=60&etag=1", nil)
+		w = do(s, "GET", "/a?cache-control=max-age=60&etag=1", http.Header{"If-None-Match": {`W/"v1"`}})
+		assert.Equal(t, http.StatusNotModified, w.Code, "client conditionals should be answered from the cache")
+		assert.Empty(t, w.Body.String())
+	})
+	t.Run("stale-while-revalidate", func(t *testing.T) {
+		s := newServer(nil)
+		path := "/a?cache-control=max-age=0,stale-while-revalidate=60"
+		get(s, path)
+		w := get(s, path)
+		assert.Equal(t, cacheStatusStale, w.Header().Get("X-Cache-Status"))
+		assert.Len(t, w.Body.String(), 2048)
+		assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, time.Millisecond*10,
+			"stale responses should be revalidated in the background")
+	})
+	t.Run("stale-if-error", func(t *testing.T) {
+		s := newServer(nil)
+		path := "/a?cache-control=max-age=0,stale-if-error=60&fail=1"
+		get(s, path)
+		w := get(s, path)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, cacheStatusStale, w.Header().Get("X-Cache-Status"))
+	})
+	t.Run("collapsed misses", func(t *testing.T) {
+		s := newServer(nil)
+		var wg sync.WaitGroup
+		codes := make(chan int, 5)
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- get(s, "/a?cache-control=max-age=60&block=1").Code
+			}()
+		}
+		assert.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond*10)
+		time.Sleep(time.Millisecond * 50)
+		close(release)
+		wg.Wait()
+		close(codes)
+		for code := range codes {
+			assert.Equal(t, http.StatusOK, code)
+		}
+		assert.Equal(t, int64(1), requests.Load(), "concurrent misses should be sent to the backend once")
+	})
+	t.Run("collapsed misses which can't be stored", func(t *testing.T) {
+		s := newServer(nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				get(s, "/a?cache-control=no-store&stream=1")
+			}()
+		}
+		assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, time.Millisecond*10,
+			"waiting requests should be sent once the response turns out not to be storable")
+		close(stream)
+		wg.Wait()
+	})
+	t.Run("invalidation", func(t *testing.T) {
+		s := newServer(nil)
+		get(s, "/a?cache-control=max-age=60")
+		do(s, "POST", "/a?cache-control=max-age=60", nil)
+		w := get(s, "/a?cache-control=max-age=60")
+		assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"), "unsafe requests should invalidate stored responses")
+	})
+	t.Run("purge", func(t *testing.T) {
+		s := newServer(nil, WithCachePurgeToken("secret"))
+		get(s, "/a/1?cache-control=max-age=60")
+		get(s, "/a/2?cache-control=max-age=60")
+		get(s, "/b?cache-control=max-age=60")
+
+		purge := func(query string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/cache/purge?"+query, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			s.adminHandler().ServeHTTP(w, r)
+			return w
+		}
+		w := purge("key=http://www.example.com/b?cache-control=max-age=60")
+		assert.JSONEq(t, `{"purged": 1}`, w.Body.String())
+		w = purge("prefix=http://www.example.com/a/")
+		assert.JSONEq(t, `{"purged": 2}`, w.Body.String())
+		assert.Equal(t, http.StatusBadRequest, purge("").Code)
+
+		w = get(s, "/a/1?cache-control=max-age=60")
+		assert.Equal(t, cacheStatusMiss, w.Header().Get("X-Cache-Status"))
+	})
+	t.Run("key", func(t *testing.T) {
+		s := newServer(nil)
+		status := func(target string) string {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+			return w.Header().Get("X-Cache-Status")
+		}
+		status("http://www.example.com/a?cache-control=max-age=60")
+		assert.Equal(t, cacheStatusHit, status("http://www.example.com:80/a?cache-control=max-age=60"), "default ports should be ignored")
+		assert.Equal(t, cacheStatusMiss, status("https://www.example.com/a?cache-control=max-age=60"), "schemes should be stored separately")
+		assert.Equal(t, cacheStatusMiss, status("http://www.example.com:8080/a?cache-control=max-age=60"), "ports should be stored separately")
+	})
+	t.Run("disk spill", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newServer(map[string]string{
+			CacheAnnotation:           "true",
+			CacheMemorySizeAnnotation: "3Ki",
+			CacheDiskSizeAnnotation:   "1Mi",
+		}, WithCacheDir(dir))
+		get(s, "/a/1?cache-control=max-age=60")
+		get(s, "/a/2?cache-control=max-age=60")
+
+		var files []string
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			sub, _ := os.ReadDir(dir + "/" + e.Name())
+			for _, f := range sub {
+				files = append(files, f.Name())
+			}
+		}
+		assert.Len(t, files, 1, "the least recently used response should be written to disk")
+
+		w := get(s, "/a/1?cache-control=max-age=60")
+		assert.Equal(t, cacheStatusHit, w.Header().Get("X-Cache-Status"))
+		assert.Len(t, w.Body.String(), 2048)
+		assert.Equal(t, int64(2), requests.Load())
+	})
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newEntry := func(header http.Header) *cacheEntry {
+		header.Set("Date", now.Format(http.TimeFormat))
+		return newCacheEntry("k", httptest.NewRequest("GET", "/", nil), 200, header, nil, now, now)
+	}
+
+	e := newEntry(http.Header{"Cache-Control": {"max-age=60"}, "Age": {"30"}})
+	assert.Equal(t, cacheEntryFresh, e.freshness(cacheControl{}, now.Add(time.Second*29)))
+	assert.Equal(t, cacheEntryStale, e.freshness(cacheControl{}, now.Add(time.Second*30)))
+	assert.Equal(t, cacheEntryStale, e.freshness(cacheControl{"max-age": "10"}, now))
+	assert.Equal(t, cacheEntryFresh, e.freshness(cacheControl{"max-stale": ""}, now.Add(time.Hour)))
+
+	e = newEntry(http.Header{"Expires": {now.Add(time.Minute).Format(http.TimeFormat)}})
+	assert.Equal(t, time.Minute, e.lifetime)
+	e = newEntry(http.Header{"Cache-Control": {"s-maxage=10, max-age=60"}})
+	assert.Equal(t, time.Second*10, e.lifetime)
+	e = newEntry(http.Header{"Last-Modified": {now.Add(-time.Hour * 10).Format(http.TimeFormat)}})
+	assert.Equal(t, time.Hour, e.lifetime, "heuristic freshness should be a tenth of the time since modification")
+
+	e = newEntry(http.Header{"Cache-Control": {"max-age=0, must-revalidate, stale-while-revalidate=60"}})
+	assert.Equal(t, cacheEntryStale, e.freshness(cacheControl{}, now))
+}
+
+func TestCacheWriter(t *testing.T) {
+	write := func(storable bool, header http.Header, body string) (*cacheWriter, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		cw := &cacheWriter{
+			ResponseWriter: rec,
+			header:         header,
+			maxSize:        10,
+			intercept:      func(int) bool { return false },
+			storable:       func(int, http.Header) bool { return storable },
+		}
+		_, _ = cw.Write([]byte(body))
+		cw.finish()
+		return cw, rec
+	}
+
+	cw, rec := write(true, http.Header{}, "abc")
+	assert.True(t, cw.buffering)
+	assert.Equal(t, "abc", cw.body.String())
+	assert.Equal(t, "abc", rec.Body.String())
+
+	cw, rec = write(false, http.Header{}, "abc")
+	assert.False(t, cw.buffering)
+	assert.Zero(t, cw.body.Len(), "responses which can't be stored should not be buffered")
+	assert.Equal(t, "abc", rec.Body.String())
+
+	cw, _ = write(true, http.Header{"Content-Length": {"11"}}, "a")
+	assert.Zero(t, cw.body.Len(), "responses larger than the max size should not be buffered")
+
+	cw, rec = write(true, http.Header{}, strings.Repeat("a", 11))
+	assert.False(t, cw.buffering)
+	assert.Zero(t, cw.body.Len(), "responses larger than the max size should not be buffered")
+	assert.Len(t, rec.Body.String(), 11)
+}
+
+func TestCacheWrite(t *testing.T) {
+	c := newResponseCache(&cacheOptions{}, "", "X-Request-Id")
+	now := time.Now()
+	e := newCacheEntry("k", httptest.NewRequest("GET", "/", nil), http.StatusOK, http.Header{
+		"Connection":   {"X-Debug"},
+		"Content-Type": {"text/plain"},
+		"Keep-Alive":   {"timeout=5"},
+		"X-Debug":      {"1"},
+		"X-Request-Id": {"stored"},
+	}, []byte("hello"), now, now)
+
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-Id", "current")
+	c.write(w, httptest.NewRequest("GET", "/", nil), e, e.body, now, cacheStatusHit)
+	assert.Equal(t, "current", w.Header().Get("X-Request-Id"), "responses should keep their own request id")
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	for _, k := range []string{"Connection", "Keep-Alive", "X-Debug"} {
+		assert.Empty(t, w.Header().Values(k), "hop-by-hop headers should not be served from the cache: %s", k)
+	}
+	assert.Equal(t, "hello", w.Body.String())
+}
+
+func TestCacheSpill(t *testing.T) {
+	dir := t.TempDir()
+	c := newResponseCache(&cacheOptions{memorySize: 1024, diskSize: 1 << 20, maxObjectSize: 1024}, dir, "")
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("http://www.example.com/%d/%d", i, j%10)
+				r := httptest.NewRequest("GET", key, nil)
+				c.store(newCacheEntry(key, r, http.StatusOK, http.Header{}, make([]byte, 256), now, now), nil)
+				if e, body := c.lookup(key, r); e != nil {
+					assert.Len(t, body, 256)
+				}
+				if j%7 == 0 {
+					c.purge(fmt.Sprintf("http://www.example.com/%d/", i), true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var memorySize, diskSize int64
+	for e := c.memory.Front(); e != nil; e = e.Next() {
+		memorySize += e.Value.(*cacheEntry).size
+	}
+	for e := c.disk.Front(); e != nil; e = e.Next() {
+		diskSize += e.Value.(*cacheEntry).size
+	}
+	assert.Equal(t, memorySize, c.memorySize)
+	assert.Equal(t, diskSize, c.diskSize)
+	assert.LessOrEqual(t, c.memorySize, int64(1024))
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, c.disk.Len(), "every spilled entry should have exactly one file")
+}
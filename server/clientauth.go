@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The client certificate verification modes.
+const (
+	ClientAuthRequired         = "required"
+	ClientAuthOptional         = "optional"
+	ClientAuthOptionalNoVerify = "optional-no-verify"
+)
+
+// The headers used to pass client certificate details to the backend.
+const (
+	ClientCertVerifyHeader  = "X-Client-Cert-Verify"
+	ClientCertSubjectHeader = "X-Client-Cert-Subject"
+	ClientCertSANHeader     = "X-Client-Cert-SAN"
+)
+
+// The values of the ClientCertVerifyHeader.
+const (
+	clientCertSuccess = "SUCCESS"
+	clientCertFailed  = "FAILED"
+	clientCertNone    = "NONE"
+)
+
+// clientAuth holds the client certificate settings for a host.
+type clientAuth struct {
+	mode string
+	pool *x509.CertPool
+}
+
+func newClientAuth(mode string, caPEM []byte) (*clientAuth, error) {
+	if mode == "" {
+		mode = ClientAuthRequired
+	}
+	switch mode {
+	case ClientAuthRequired, ClientAuthOptional, ClientAuthOptionalNoVerify:
+	default:
+		return nil, fmt.Errorf("unknown client certificate verification mode: %s", mode)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no valid CA certificates found")
+	}
+	return &clientAuth{mode: mode, pool: pool}, nil
+}
+
+// clientAuthType returns the client auth policy used during the TLS handshake.
+func (ca *clientAuth) clientAuthType() tls.ClientAuthType {
+	switch ca.mode {
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthOptionalNoVerify:
+		return tls.RequestClientCert
+	default:
+		return tls.RequireAndVerifyClientCert
+	}
+}
+
+// verify verifies the certificate presented by the client. The handshake may have been done for a
+// different SNI than the request's host, so the chain is always verified against this host's CAs.
+func (ca *clientAuth) verify(state *tls.ConnectionState) (*x509.Certificate, string) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil, clientCertNone
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         ca.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return leaf, clientCertFailed
+	}
+	return leaf, clientCertSuccess
+}
+
+// authorize checks the client certificate for the request and sets the client certificate headers.
+// It returns false if the request should be rejected.
+func (ca *clientAuth) authorize(r *http.Request) bool {
+	leaf, status := ca.verify(r.TLS)
+	switch {
+	case status == clientCertSuccess:
+	case ca.mode == ClientAuthRequired:
+		return false
+	case ca.mode == ClientAuthOptional && status == clientCertFailed:
+		return false
+	}
+
+	r.Header.Set(ClientCertVerifyHeader, status)
+	if leaf != nil {
+		r.Header.Set(ClientCertSubjectHeader, leaf.Subject.String())
+		if san := formatSAN(leaf); san != "" {
+			r.Header.Set(ClientCertSANHeader, san)
+		}
+	}
+	return true
+}
+
+// removeClientCertHeaders removes any client certificate headers sent by the client.
+func removeClientCertHeaders(h http.Header) {
+	h.Del(ClientCertVerifyHeader)
+	h.Del(ClientCertSubjectHeader)
+	h.Del(ClientCertSANHeader)
+}
+
+func formatSAN(cert *x509.Certificate) string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		names = append(names, "URI:"+u.String())
+	}
+	return strings.Join(names, ", ")
+}
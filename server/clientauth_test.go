@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	otherCA := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other-ca"}})
+	client := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		DNSNames:    []string{"client.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	untrusted := newTestCertificate(t, otherCA, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "untrusted"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	connectionState := func(cert *testCertificate) *tls.ConnectionState {
+		state := &tls.ConnectionState{}
+		if cert != nil {
+			state.PeerCertificates = []*x509.Certificate{cert.cert}
+		}
+		return state
+	}
+
+	t.Run("invalid mode", func(t *testing.T) {
+		_, err := newClientAuth("sometimes", ca.pem)
+		assert.Error(t, err)
+	})
+	t.Run("invalid ca", func(t *testing.T) {
+		_, err := newClientAuth(ClientAuthRequired, []byte("not a certificate"))
+		assert.Error(t, err)
+	})
+	for _, tc := range []struct {
+		mode       string
+		cert       *testCertificate
+		authorized bool
+		verify     string
+	}{
+		{ClientAuthRequired, client, true, clientCertSuccess},
+		{ClientAuthRequired, nil, false, ""},
+		{ClientAuthRequired, untrusted, false, ""},
+		{ClientAuthOptional, client, true, clientCertSuccess},
+		{ClientAuthOptional, nil, true, clientCertNone},
+		{ClientAuthOptional, untrusted, false, ""},
+		{ClientAuthOptionalNoVerify, untrusted, true, clientCertFailed},
+	} {
+		ca, err := newClientAuth(tc.mode, ca.pem)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		r := httptest.NewRequest("GET", "https://www.example.com/", nil)
+		r.TLS = connectionState(tc.cert)
+		assert.Equal(t, tc.authorized, ca.authorize(r), "mode=%s", tc.mode)
+		assert.Equal(t, tc.verify, r.Header.Get(ClientCertVerifyHeader), "mode=%s", tc.mode)
+		if tc.cert == client {
+			assert.Equal(t, "CN=client", r.Header.Get(ClientCertSubjectHeader))
+			assert.Equal(t, "DNS:client.example.com", r.Header.Get(ClientCertSANHeader))
+		}
+	}
+}
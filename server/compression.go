@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The supported response content encodings.
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// DefaultCompressionTypes are the media types compressed by default.
+var DefaultCompressionTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// DefaultCompressionMinSize is the default size in bytes below which responses are not compressed.
+const DefaultCompressionMinSize = 1024
+
+// A CompressionPolicy describes which responses are compressed and how.
+type CompressionPolicy struct {
+	// Encodings are the content encodings offered to clients in order of preference.
+	Encodings []string
+	// Types are the compressed media types. A type of the form "text/*" matches every subtype.
+	Types []string
+	// MinSize is the size in bytes below which responses are not compressed.
+	MinSize int
+}
+
+// ParseCompressionPolicy parses a CompressionPolicy. Encodings (br, zstd or gzip) and types are
+// comma-separated. Empty values use the defaults.
+func ParseCompressionPolicy(encodings, types, minSize string) (CompressionPolicy, error) {
+	p := CompressionPolicy{
+		Encodings: []string{EncodingBrotli, EncodingZstd, EncodingGzip},
+		Types:     DefaultCompressionTypes,
+		MinSize:   DefaultCompressionMinSize,
+	}
+
+	if encodings != "" {
+		p.Encodings = nil
+		for _, encoding := range splitList(encodings) {
+			encoding = strings.ToLower(encoding)
+			if _, ok := compressors[encoding]; !ok {
+				return p, fmt.Errorf("unknown content encoding: %s", encoding)
+			}
+			p.Encodings = append(p.Encodings, encoding)
+		}
+	}
+
+	if types != "" {
+		p.Types = nil
+		for _, typ := range splitList(types) {
+			typ = strings.ToLower(typ)
+			if !strings.Contains(typ, "/") {
+				return p, fmt.Errorf("invalid media type: %s", typ)
+			}
+			p.Types = append(p.Types, typ)
+		}
+	}
+
+	if minSize != "" {
+		var err error
+		p.MinSize, err = strconv.Atoi(minSize)
+		if err != nil || p.MinSize < 0 {
+			return p, fmt.Errorf("invalid minimum size: %s", minSize)
+		}
+	}
+
+	return p, nil
+}
+
+// negotiate returns the preferred encoding accepted by the client, or "" if there is none.
+func (p *CompressionPolicy) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range p.Encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+func (p *CompressionPolicy) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, typ := range p.Types {
+		if typ == mediaType || (strings.HasSuffix(typ, "/*") && strings.HasPrefix(mediaType, typ[:len(typ)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionOptions are the per-ingress compression settings.
+type compressionOptions struct {
+	disabled bool
+	policy   CompressionPolicy
+}
+
+func parseCompression(enabled, encodings, types, minSize string) (*compressionOptions, error) {
+	opts := new(compressionOptions)
+	if enabled != "" {
+		v, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression: %s", enabled)
+		}
+		opts.disabled = !v
+	}
+	var err error
+	opts.policy, err = ParseCompressionPolicy(encodings, types, minSize)
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// A compressor is a pooled encoder writing to an underlying writer.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var compressors = map[string]*sync.Pool{
+	EncodingBrotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	EncodingZstd: {New: func() interface{} {
+		// browsers only accept windows up to 8MB
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<22))
+		return w
+	}},
+	EncodingGzip: {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+}
+
+// A compressWriter compresses the response written to it if it's eligible and the client accepts
+// one of the policy's encodings. Responses without a Content-Length are buffered until they reach the
+// minimum size.
+type compressWriter struct {
+	http.ResponseWriter
+	policy   *CompressionPolicy
+	encoding string
+
+	status      int
+	wroteHeader bool
+	pending     bool
+	buf         bytes.Buffer
+	compressor  compressor
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request, policy *CompressionPolicy) *compressWriter {
+	cw := &compressWriter{ResponseWriter: w, policy: policy}
+	if r.Method != http.MethodHead {
+		cw.encoding = policy.negotiate(r.Header.Get("Accept-Encoding"))
+	}
+	return cw
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status < 200 {
+		// informational responses are passed through as they are
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	h := cw.Header()
+	if !cw.eligible(status, h) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// the response depends on the client's encodings even when it isn't compressed
+	addVary(h, "Accept-Encoding")
+	if cw.encoding == "" {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if v := h.Get("Content-Length"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n < cw.policy.MinSize {
+			cw.ResponseWriter.WriteHeader(status)
+			return
+		}
+		cw.startCompression()
+		return
+	}
+	cw.pending = true
+}
+
+func (cw *compressWriter) eligible(status int, h http.Header) bool {
+	switch {
+	case status == http.StatusNoContent, status == http.StatusNotModified, status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "" && !strings.EqualFold(h.Get("Content-Encoding"), "identity"):
+		return false
+	case h.Get("Content-Range") != "":
+		return false
+	case hasCacheDirective(h.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+	return cw.policy.compressible(h.Get("Content-Type"))
+}
+
+func (cw *compressWriter) startCompression() {
+	h := cw.Header()
+	h.Del("Content-Length")
+	// byte ranges of the original representation don't apply to the compressed one
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", cw.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed representation isn't byte-for-byte identical to the original
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	cw.compressor = compressors[cw.encoding].Get().(compressor)
+	cw.compressor.Reset(cw.ResponseWriter)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.compressor != nil:
+		return cw.compressor.Write(p)
+	case cw.pending:
+		cw.buf.Write(p)
+		if cw.buf.Len() >= cw.policy.MinSize {
+			if err := cw.flushPending(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// flushPending writes the headers and any buffered body once it's known whether to compress.
+func (cw *compressWriter) flushPending(compress bool) error {
+	if !cw.pending {
+		return nil
+	}
+	cw.pending = false
+	if compress {
+		cw.startCompression()
+		_, err := cw.compressor.Write(cw.buf.Bytes())
+		cw.buf.Reset()
+		return err
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+	cw.buf.Reset()
+	return err
+}
+
+func (cw *compressWriter) Flush() {
+	// a flush means the backend is streaming, so compress without waiting for the minimum size
+	_ = cw.flushPending(true)
+	if cw.compressor != nil {
+		_ = cw.compressor.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any buffered response and finishes compression.
+func (cw *compressWriter) Close() error {
+	if err := cw.flushPending(false); err != nil {
+		return err
+	}
+	if cw.compressor == nil {
+		return nil
+	}
+	err := cw.compressor.Close()
+	cw.compressor.Reset(nil)
+	compressors[cw.encoding].Put(cw.compressor)
+	cw.compressor = nil
+	return err
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := cw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+func hasCacheDirective(cacheControl, directive string) bool {
+	for _, v := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(v), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		w.Header().Set("Content-Type", q.Get("type"))
+		if v := q.Get("encoding"); v != "" {
+			w.Header().Set("Content-Encoding", v)
+		}
+		if v := q.Get("cache-control"); v != "" {
+			w.Header().Set("Cache-Control", v)
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Accept-Ranges", "bytes")
+		b := body
+		if v := q.Get("size"); v != "" {
+			n, _ := strconv.Atoi(v)
+			b = body[:n]
+		}
+		if q.Get("length") != "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		}
+		if q.Get("stream") != "" {
+			_, _ = io.WriteString(w, b[:10])
+			w.(http.Flusher).Flush()
+			b = b[10:]
+		}
+		_, _ = io.WriteString(w, b)
+	}))
+	defer backend.Close()
+
+	newServer := func(annotations map[string]string, options ...Option) *Server {
+		s := New(options...)
+		s.Update(newTestPayload(annotations, hostOf(backend)))
+		return s
+	}
+	get := func(s *Server, query, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://www.example.com/a?"+query, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) string {
+		var r io.Reader
+		switch w.Header().Get("Content-Encoding") {
+		case EncodingGzip:
+			zr, err := gzip.NewReader(w.Body)
+			if !assert.NoError(t, err) {
+				return ""
+			}
+			r = zr
+		case EncodingBrotli:
+			r = brotli.NewReader(w.Body)
+		case EncodingZstd:
+			zr, err := zstd.NewReader(w.Body)
+			if !assert.NoError(t, err) {
+				return ""
+			}
+			defer zr.Close()
+			r = zr
+		default:
+			r = w.Body
+		}
+		bs, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		return string(bs)
+	}
+
+	policy, err := ParseCompressionPolicy("", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	global := newServer(nil, WithCompression(&policy))
+
+	t.Run("encodings", func(t *testing.T) {
+		for _, tc := range []struct {
+			acceptEncoding, expect string
+		}{
+			{"gzip", EncodingGzip},
+			{"gzip, deflate, br", EncodingBrotli},
+			{"gzip, zstd", EncodingZstd},
+			{"br;q=0.5, gzip", EncodingGzip},
+			{"br;q=0, *", EncodingZstd},
+			{"deflate", ""},
+			{"", ""},
+		} {
+			w := get(global, "type=text/html&length=1", tc.acceptEncoding)
+			assert.Equal(t, tc.expect, w.Header().Get("Content-Encoding"), tc.acceptEncoding)
+			assert.Equal(t, body, decode(t, w), tc.acceptEncoding)
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), tc.acceptEncoding)
+			if tc.expect != "" {
+				assert.Empty(t, w.Header().Get("Content-Length"))
+				assert.Equal(t, `W/"abc"`, w.Header().Get("ETag"))
+				assert.Empty(t, w.Header().Get("Accept-Ranges"), "ranges should not be advertised for compressed responses")
+			} else {
+				assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"), tc.acceptEncoding)
+			}
+		}
+	})
+	t.Run("eligibility", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, query string
+			compressed  bool
+		}{
+			{"json", "type=application/json%3B+charset=utf-8", true},
+			{"unknown length", "type=text/plain", true},
+			{"streaming", "type=text/plain&stream=1", true},
+			{"image", "type=image/png", false},
+			{"small", "type=text/plain&size=100&length=1", false},
+			{"small unknown length", "type=text/plain&size=100", false},
+			{"no-transform", "type=text/plain&cache-control=public,+no-transform", false},
+			{"already encoded", "type=text/plain&encoding=gzip", false},
+		} {
+			w := get(global, tc.query, "gzip")
+			if tc.compressed {
+				assert.Equal(t, EncodingGzip, w.Header().Get("Content-Encoding"), tc.name)
+				assert.Equal(t, body, decode(t, w), tc.name)
+			} else {
+				if tc.name != "already encoded" {
+					assert.Empty(t, w.Header().Get("Content-Encoding"), tc.name)
+				}
+				assert.True(t, strings.HasPrefix(body, w.Body.String()), "%s: the body should not be compressed", tc.name)
+			}
+		}
+	})
+	t.Run("per ingress", func(t *testing.T) {
+		s := newServer(map[string]string{CompressionAnnotation: "true", CompressionEncodingsAnnotation: "gzip"})
+		w := get(s, "type=text/plain", "br, gzip")
+		assert.Equal(t, EncodingGzip, w.Header().Get("Content-Encoding"))
+
+		s = newServer(nil)
+		w = get(s, "type=text/plain", "gzip")
+		assert.Empty(t, w.Header().Get("Content-Encoding"), "compression should be off by default")
+
+		s = newServer(map[string]string{CompressionAnnotation: "false"}, WithCompression(&policy))
+		w = get(s, "type=text/plain", "gzip")
+		assert.Empty(t, w.Header().Get("Content-Encoding"), "ingresses should be able to disable compression")
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseCompressionPolicy("deflate", "", "")
+		assert.Error(t, err)
+		_, err = ParseCompressionPolicy("", "text", "")
+		assert.Error(t, err)
+		_, err = ParseCompressionPolicy("", "", "-1")
+		assert.Error(t, err)
+	})
+}
@@ -1,16 +1,86 @@
 package server
 
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
 type config struct {
-	host    string
-	port    int
-	tlsPort int
+	host      string
+	port      int
+	tlsPort   int
+	adminHost string
+	adminPort int
+	http3     bool
+
+	ocspStapling        bool
+	ocspResponderURL    string
+	ocspRefreshInterval time.Duration
+
+	tlsPolicy TLSPolicy
+
+	sessionTicketRotation time.Duration
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	maxConnections         int
+	connectionQueueTimeout time.Duration
+
+	trustedProxies []*net.IPNet
+
+	requestIDHeader string
+	accessLogger    *AccessLogger
+
+	compression     *CompressionPolicy
+	cacheDir        string
+	cachePurgeToken string
+
+	tracerProvider  trace.TracerProvider
+	tracePropagator propagation.TextMapPropagator
+
+	proxyProtocol        bool
+	proxyProtocolTrusted []*net.IPNet
+
+	backendKeepAlive           time.Duration
+	backendIdleConnTimeout     time.Duration
+	backendMaxIdleConns        int
+	backendMaxIdleConnsPerHost int
+
+	rateLimitStore RateLimitStore
 }
 
 func defaultConfig() *config {
 	return &config{
-		host:    "0.0.0.0",
-		port:    80,
-		tlsPort: 443,
+		host:      "0.0.0.0",
+		port:      80,
+		tlsPort:   443,
+		adminPort: 10254,
+
+		ocspStapling:        true,
+		ocspRefreshInterval: time.Minute * 10,
+
+		sessionTicketRotation: time.Hour,
+
+		requestIDHeader: "X-Request-Id",
+
+		tracerProvider:  noop.NewTracerProvider(),
+		tracePropagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+
+		readHeaderTimeout: time.Second * 10,
+		idleTimeout:       time.Minute * 2,
+
+		backendKeepAlive:           time.Second * 30,
+		backendIdleConnTimeout:     time.Second * 90,
+		backendMaxIdleConns:        100,
+		backendMaxIdleConnsPerHost: 32,
 	}
 }
 
@@ -37,3 +107,219 @@ func WithTLSPort(port int) Option {
 		cfg.tlsPort = port
 	}
 }
+
+// WithAdminHost sets the host the admin API binds in the config. An empty host binds the same host as the
+// other listeners.
+func WithAdminHost(host string) Option {
+	return func(cfg *config) {
+		cfg.adminHost = host
+	}
+}
+
+// WithAdminPort sets the port of the admin API in the config. A port of 0 disables the admin API.
+func WithAdminPort(port int) Option {
+	return func(cfg *config) {
+		cfg.adminPort = port
+	}
+}
+
+// WithHTTP3 enables or disables the HTTP/3 listener on the TLS port in the config.
+func WithHTTP3(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.http3 = enabled
+	}
+}
+
+// WithOCSPStapling enables or disables OCSP stapling in the config.
+func WithOCSPStapling(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.ocspStapling = enabled
+	}
+}
+
+// WithOCSPResponderURL overrides the OCSP responder URL found in certificates in the config.
+func WithOCSPResponderURL(responderURL string) Option {
+	return func(cfg *config) {
+		cfg.ocspResponderURL = responderURL
+	}
+}
+
+// WithOCSPRefreshInterval sets how often OCSP responses are checked for expiry in the config.
+func WithOCSPRefreshInterval(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.ocspRefreshInterval = interval
+	}
+}
+
+// WithTLSPolicy sets the controller-wide TLS policy in the config.
+func WithTLSPolicy(policy TLSPolicy) Option {
+	return func(cfg *config) {
+		cfg.tlsPolicy = policy
+	}
+}
+
+// WithSessionTicketRotation sets how often TLS session ticket keys are rotated in the config.
+func WithSessionTicketRotation(interval time.Duration) Option {
+	return func(cfg *config) {
+		cfg.sessionTicketRotation = interval
+	}
+}
+
+// WithReadHeaderTimeout sets the time allowed for clients to send request headers in the config.
+func WithReadHeaderTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.readHeaderTimeout = timeout
+	}
+}
+
+// WithReadTimeout sets the time allowed for clients to send the entire request in the config.
+// A timeout of 0 means no timeout.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.readTimeout = timeout
+	}
+}
+
+// WithWriteTimeout sets the time allowed to write the response to clients in the config. A timeout
+// of 0 means no timeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.writeTimeout = timeout
+	}
+}
+
+// WithIdleTimeout sets how long idle client connections are kept open in the config.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.idleTimeout = timeout
+	}
+}
+
+// WithMaxConnections sets the maximum number of client connections per listener in the config. A
+// maximum of 0 means no limit.
+func WithMaxConnections(n int) Option {
+	return func(cfg *config) {
+		cfg.maxConnections = n
+	}
+}
+
+// WithConnectionQueueTimeout sets how long connections beyond the maximum wait for a free slot before
+// being dropped in the config.
+func WithConnectionQueueTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.connectionQueueTimeout = timeout
+	}
+}
+
+// WithTrustedProxies sets the networks of proxies whose forwarded headers are trusted in the config.
+func WithTrustedProxies(networks []*net.IPNet) Option {
+	return func(cfg *config) {
+		cfg.trustedProxies = networks
+	}
+}
+
+// WithRequestIDHeader sets the header used to pass request IDs in the config.
+func WithRequestIDHeader(header string) Option {
+	return func(cfg *config) {
+		cfg.requestIDHeader = http.CanonicalHeaderKey(header)
+	}
+}
+
+// WithAccessLogger sets the access logger in the config. Without one no access logs are written.
+func WithAccessLogger(logger *AccessLogger) Option {
+	return func(cfg *config) {
+		cfg.accessLogger = logger
+	}
+}
+
+// WithCompression sets the policy used to compress responses of every ingress in the config. A nil
+// policy only compresses the responses of ingresses which enable it by annotation.
+func WithCompression(policy *CompressionPolicy) Option {
+	return func(cfg *config) {
+		cfg.compression = policy
+	}
+}
+
+// WithCacheDir sets the directory response caches spill to in the config. Without one responses are
+// only cached in memory.
+func WithCacheDir(dir string) Option {
+	return func(cfg *config) {
+		cfg.cacheDir = dir
+	}
+}
+
+// WithCachePurgeToken sets the bearer token required to purge cached responses via the admin API in the
+// config. Without one purging is disabled.
+func WithCachePurgeToken(token string) Option {
+	return func(cfg *config) {
+		cfg.cachePurgeToken = token
+	}
+}
+
+// WithTracerProvider sets the provider of the tracer used to trace requests in the config. By default
+// no spans are recorded.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(cfg *config) {
+		cfg.tracerProvider = provider
+	}
+}
+
+// WithTracePropagator sets how trace context is read from clients and passed to backends in the
+// config. By default W3C trace context and baggage headers are used.
+func WithTracePropagator(propagator propagation.TextMapPropagator) Option {
+	return func(cfg *config) {
+		cfg.tracePropagator = propagator
+	}
+}
+
+// WithProxyProtocol enables decoding PROXY protocol headers on the listeners in the config.
+func WithProxyProtocol(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.proxyProtocol = enabled
+	}
+}
+
+// WithProxyProtocolTrusted sets the networks allowed to send PROXY protocol headers in the config. At
+// least one network is required when PROXY protocol is enabled.
+func WithProxyProtocolTrusted(networks []*net.IPNet) Option {
+	return func(cfg *config) {
+		cfg.proxyProtocolTrusted = networks
+	}
+}
+
+// WithBackendKeepAlive sets the TCP keep-alive period of backend connections in the config.
+func WithBackendKeepAlive(keepAlive time.Duration) Option {
+	return func(cfg *config) {
+		cfg.backendKeepAlive = keepAlive
+	}
+}
+
+// WithBackendIdleConnTimeout sets how long idle backend connections are kept open in the config.
+func WithBackendIdleConnTimeout(timeout time.Duration) Option {
+	return func(cfg *config) {
+		cfg.backendIdleConnTimeout = timeout
+	}
+}
+
+// WithBackendMaxIdleConns sets the maximum number of idle connections kept per backend in the config.
+func WithBackendMaxIdleConns(n int) Option {
+	return func(cfg *config) {
+		cfg.backendMaxIdleConns = n
+	}
+}
+
+// WithBackendMaxIdleConnsPerHost sets the maximum number of idle connections kept per backend host in
+// the config.
+func WithBackendMaxIdleConnsPerHost(n int) Option {
+	return func(cfg *config) {
+		cfg.backendMaxIdleConnsPerHost = n
+	}
+}
+
+// WithRateLimitStore sets the store shared by every rate limit in the config. By default each
+// ingress's rate limit is kept in memory.
+func WithRateLimitStore(store RateLimitStore) Option {
+	return func(cfg *config) {
+		cfg.rateLimitStore = store
+	}
+}
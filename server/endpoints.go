@@ -0,0 +1,196 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// An endpointTransport sends requests to the endpoints of a backend in round-robin order, retrying
+// failed requests on other endpoints according to the backend's retry policy. Without any known
+// endpoints, requests are sent to the service address. Failing endpoints are ejected according to
+// the backend's outlier detection.
+type endpointTransport struct {
+	next    http.RoundTripper
+	host    string
+	retry   *retryPolicy
+	budget  *retryBudget
+	outlier *outlierDetection
+
+	endpoints atomic.Value // []string
+	counter   uint32
+
+	mu     sync.Mutex
+	health map[string]*endpointHealth
+}
+
+func newEndpointTransport(next http.RoundTripper, host string, opts *ingressOptions) *endpointTransport {
+	t := &endpointTransport{
+		next:    next,
+		host:    host,
+		retry:   opts.retry,
+		outlier: opts.outlier,
+		health:  make(map[string]*endpointHealth),
+	}
+	if t.retry != nil {
+		t.budget = newRetryBudget(t.retry.budgetPercent)
+	}
+	t.endpoints.Store([]string(nil))
+	return t
+}
+
+func (t *endpointTransport) setEndpoints(endpoints []string) {
+	t.endpoints.Store(endpoints)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := make(map[string]bool, len(endpoints))
+	for _, endpoint := range t.getEndpoints() {
+		current[endpoint] = true
+	}
+	for endpoint := range t.health {
+		if !current[endpoint] {
+			delete(t.health, endpoint)
+		}
+	}
+}
+
+func (t *endpointTransport) getEndpoints() []string {
+	endpoints := t.endpoints.Load().([]string)
+	if len(endpoints) == 0 {
+		return []string{t.host}
+	}
+	return endpoints
+}
+
+func (t *endpointTransport) getHealth(endpoint string) *endpointHealth {
+	h, ok := t.health[endpoint]
+	if !ok {
+		h = new(endpointHealth)
+		t.health[endpoint] = h
+	}
+	return h
+}
+
+// pick picks the next available endpoint, preferring endpoints that haven't been tried yet. It
+// returns an empty string if every endpoint has been ejected.
+func (t *endpointTransport) pick(tried map[string]bool, now time.Time) string {
+	endpoints := t.getEndpoints()
+	start := int(atomic.AddUint32(&t.counter, 1))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fallback := ""
+	for i := 0; i < len(endpoints); i++ {
+		endpoint := endpoints[(start+i)%len(endpoints)]
+		if h, ok := t.health[endpoint]; ok && !h.available(now) {
+			continue
+		}
+		if !tried[endpoint] {
+			return endpoint
+		}
+		if fallback == "" {
+			fallback = endpoint
+		}
+	}
+	return fallback
+}
+
+// record records the result of a request to an endpoint for outlier detection.
+func (t *endpointTransport) record(endpoint string, res *http.Response, err error, latency time.Duration) {
+	if t.outlier == nil {
+		return
+	}
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	failed := t.outlier.isFailure(statusCode, err, latency)
+
+	t.mu.Lock()
+	ejected := t.getHealth(endpoint).record(t.outlier, failed, time.Now())
+	t.mu.Unlock()
+
+	if ejected {
+		log.Warn().Str("backend", t.host).Str("endpoint", endpoint).Msg("ejecting failing endpoint")
+	}
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryable := t.retry.canRetry(req)
+	if retryable {
+		var err error
+		if retryable, err = bufferBody(req); err != nil {
+			return nil, err
+		}
+	}
+	if t.budget != nil {
+		t.budget.recordRequest(time.Now())
+	}
+
+	tried := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		endpoint := t.pick(tried, time.Now())
+		if endpoint == "" {
+			return nil, fmt.Errorf("%w: no available endpoints", errCircuitOpen)
+		}
+		tried[endpoint] = true
+
+		outreq := req.Clone(req.Context())
+		outreq.URL.Host = endpoint
+		if attempt > 0 && req.GetBody != nil {
+			outreq.Body, _ = req.GetBody()
+		}
+
+		start := time.Now()
+		res, err := t.next.RoundTrip(outreq)
+		getRequestInfo(req.Context()).recordUpstream(endpoint, time.Since(start))
+		if req.Context().Err() != nil {
+			// the client went away or the request timed out, so this says nothing about the endpoint
+			return res, err
+		}
+		if !isCircuitOpen(err) {
+			t.record(endpoint, res, err, time.Since(start))
+		}
+		if !retryable || attempt >= t.retry.attempts || !t.shouldRetry(res, err) {
+			return res, err
+		}
+		if !t.budget.allowRetry(time.Now()) {
+			requestLogger(req).Warn().Str("host", req.Host).Str("path", req.URL.Path).Msg("retry budget exhausted")
+			return res, err
+		}
+
+		event := requestLogger(req).Info().Str("host", req.Host).Str("path", req.URL.Path).Str("endpoint", endpoint).Int("attempt", attempt+1)
+		if err != nil {
+			event = event.Err(err)
+		} else {
+			event = event.Int("status", res.StatusCode)
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+			_ = res.Body.Close()
+		}
+		event.Msg("retrying request")
+	}
+}
+
+func (t *endpointTransport) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return !isCircuitOpen(err)
+	}
+	return t.retry.shouldRetryStatus(res.StatusCode)
+}
+
+func (t *endpointTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func isCircuitOpen(err error) bool {
+	return err != nil && errors.Is(err, errCircuitOpen)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The headers describing the original request sent to forward auth services.
+const (
+	forwardAuthMethodHeader = "X-Forwarded-Method"
+	forwardAuthURIHeader    = "X-Forwarded-Uri"
+)
+
+const (
+	defaultForwardAuthTimeout = time.Second * 5
+	// maxForwardAuthBody limits the size of auth service responses passed back to clients.
+	maxForwardAuthBody = 64 << 10
+	// maxForwardAuthResults limits how many cached auth results are kept per ingress.
+	maxForwardAuthResults = 10000
+)
+
+var defaultForwardAuthRequestHeaders = []string{"Authorization", "Cookie"}
+
+// forwardAuthForwardedHeaders are the forwarded headers describing the client which are always sent
+// to the auth service.
+var forwardAuthForwardedHeaders = []string{headerXForwardedFor, headerXForwardedHost, headerXForwardedProto, headerXRealIP}
+
+// forwardAuthTransport is shared by every forward auth service.
+var forwardAuthTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// forwardAuth authorizes requests with an external auth service.
+type forwardAuth struct {
+	url             *url.URL
+	requestHeaders  []string
+	responseHeaders []string
+	cacheTTL        time.Duration
+	client          *http.Client
+
+	mu      sync.Mutex
+	results map[[sha256.Size]byte]*forwardAuthResult
+}
+
+// A forwardAuthResult is the response of the auth service to a request.
+type forwardAuthResult struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (result *forwardAuthResult) allowed() bool {
+	return result.status/100 == 2
+}
+
+func parseForwardAuth(rawURL, requestHeaders, responseHeaders, cacheTTL, timeout string) (*forwardAuth, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("expected an http or https url: %s", rawURL)
+	}
+
+	fa := &forwardAuth{
+		url:            u,
+		requestHeaders: defaultForwardAuthRequestHeaders,
+		results:        make(map[[sha256.Size]byte]*forwardAuthResult),
+	}
+	if requestHeaders != "" {
+		fa.requestHeaders = nil
+		for _, name := range splitList(requestHeaders) {
+			fa.requestHeaders = append(fa.requestHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+	for _, name := range splitList(responseHeaders) {
+		fa.responseHeaders = append(fa.responseHeaders, http.CanonicalHeaderKey(name))
+	}
+	if cacheTTL != "" {
+		if fa.cacheTTL, err = parseDuration(cacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid cache ttl: %w", err)
+		}
+	}
+	d := defaultForwardAuthTimeout
+	if timeout != "" {
+		if d, err = parseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	fa.client = &http.Client{
+		Transport: forwardAuthTransport,
+		Timeout:   d,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			// redirects are passed back to the client
+			return http.ErrUseLastResponse
+		},
+	}
+	return fa, nil
+}
+
+// authorize asks the auth service whether a request is allowed. Allowed requests get the auth
+// service's response headers, other requests are answered with the auth service's response.
+func (fa *forwardAuth) authorize(w http.ResponseWriter, r *http.Request) bool {
+	result, err := fa.check(r)
+	if err != nil {
+		requestLogger(r).Error().Err(err).Str("host", r.Host).Str("path", r.URL.Path).Msg("forward auth failed")
+		http.Error(w, "authorization failed", http.StatusInternalServerError)
+		return false
+	}
+
+	if result.allowed() {
+		for _, name := range fa.responseHeaders {
+			// clients mustn't be able to set the headers themselves
+			r.Header.Del(name)
+			if vs, ok := result.header[name]; ok {
+				r.Header[name] = append([]string(nil), vs...)
+			}
+		}
+		return true
+	}
+
+	switch {
+	case result.status == http.StatusUnauthorized, result.status == http.StatusForbidden,
+		result.status >= 300 && result.status < 400 && result.status != http.StatusNotModified:
+		h := w.Header()
+		for k, vs := range result.header {
+			h[k] = append([]string(nil), vs...)
+		}
+		w.WriteHeader(result.status)
+		_, _ = w.Write(result.body)
+	default:
+		requestLogger(r).Error().Int("status", result.status).Str("host", r.Host).Str("path", r.URL.Path).
+			Msg("unexpected forward auth response")
+		http.Error(w, "authorization failed", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// check returns the auth service's response to a request, from the cache if possible.
+func (fa *forwardAuth) check(r *http.Request) (*forwardAuthResult, error) {
+	var key [sha256.Size]byte
+	if fa.cacheTTL > 0 {
+		key = fa.cacheKey(r)
+		fa.mu.Lock()
+		result, ok := fa.results[key]
+		fa.mu.Unlock()
+		if ok && time.Now().Before(result.expires) {
+			return result, nil
+		}
+	}
+
+	result, err := fa.send(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if fa.cacheTTL > 0 && result.status < 500 {
+		result.expires = time.Now().Add(fa.cacheTTL)
+		fa.mu.Lock()
+		if len(fa.results) >= maxForwardAuthResults {
+			now := time.Now()
+			for k, v := range fa.results {
+				if !now.Before(v.expires) {
+					delete(fa.results, k)
+				}
+			}
+			if len(fa.results) >= maxForwardAuthResults {
+				clear(fa.results)
+			}
+		}
+		fa.results[key] = result
+		fa.mu.Unlock()
+	}
+	return result, nil
+}
+
+// send sends the subrequest for a request to the auth service. It has the original method but no body.
+func (fa *forwardAuth) send(r *http.Request) (*forwardAuthResult, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, fa.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range fa.requestHeaders {
+		if vs, ok := r.Header[name]; ok {
+			req.Header[name] = append([]string(nil), vs...)
+		}
+	}
+	req.Header.Set(forwardAuthMethodHeader, r.Method)
+	req.Header.Set(forwardAuthURIHeader, r.URL.RequestURI())
+	for _, name := range forwardAuthForwardedHeaders {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	res, err := fa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	result := &forwardAuthResult{status: res.StatusCode}
+	if result.allowed() {
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, maxForwardAuthBody))
+		result.header = make(http.Header)
+		for _, name := range fa.responseHeaders {
+			if vs, ok := res.Header[name]; ok {
+				result.header[name] = vs
+			}
+		}
+		return result, nil
+	}
+
+	result.body, err = io.ReadAll(io.LimitReader(res.Body, maxForwardAuthBody))
+	if err != nil {
+		return nil, err
+	}
+	result.header = res.Header.Clone()
+	result.header.Del("Content-Length")
+	result.header.Del("Transfer-Encoding")
+	result.header.Del("Connection")
+	return result, nil
+}
+
+// cacheKey identifies the requests which get the same response from the auth service: those with the
+// same method, URL, request headers and forwarded headers, so results aren't shared between clients.
+func (fa *forwardAuth) cacheKey(r *http.Request) [sha256.Size]byte {
+	h := sha256.New()
+	write := func(values ...string) {
+		for _, v := range values {
+			_, _ = fmt.Fprintf(h, "%d:%s", len(v), v)
+		}
+	}
+	write(r.Method, strings.ToLower(r.Host), r.URL.RequestURI())
+	for _, name := range fa.requestHeaders {
+		values := r.Header.Values(name)
+		write(name, strconv.Itoa(len(values)))
+		write(values...)
+	}
+	for _, name := range forwardAuthForwardedHeaders {
+		write(r.Header.Get(name))
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Method + " " + r.Header.Get("X-Auth-User")))
+	}))
+	defer backend.Close()
+
+	var calls atomic.Int32
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.Header.Get("Cookie") {
+		case "session=alice":
+			assert.Equal(t, r.Method, r.Header.Get("X-Forwarded-Method"))
+			assert.Equal(t, "/a?x=1", r.Header.Get("X-Forwarded-Uri"))
+			assert.Equal(t, "www.example.com", r.Header.Get("X-Forwarded-Host"))
+			assert.Empty(t, r.Header.Get("X-Other"), "unselected headers should not be sent")
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Auth-Internal", "internal")
+		case "session=mallory":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "session=broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.Redirect(w, r, "https://sso.example.com/login", http.StatusFound)
+		}
+	}))
+	defer auth.Close()
+
+	newServer := func(annotations map[string]string) *Server {
+		s := New()
+		s.Update(newTestPayload(annotations, hostOf(backend)))
+		return s
+	}
+	do := func(s *Server, method, cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://www.example.com/a?x=1", nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		r.Header.Set("X-Auth-User", "spoofed")
+		r.Header.Set("X-Other", "other")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	s := newServer(map[string]string{
+		AuthURLAnnotation:             auth.URL + "/verify",
+		AuthResponseHeadersAnnotation: "x-auth-user",
+	})
+	w := do(s, "POST", "session=alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "POST alice", w.Body.String(), "response headers should replace the client's")
+
+	w = do(s, "GET", "session=mallory")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "forbidden\n", w.Body.String())
+
+	w = do(s, "GET", "")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://sso.example.com/login", w.Header().Get("Location"))
+
+	w = do(s, "GET", "session=broken")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	t.Run("cache", func(t *testing.T) {
+		s := newServer(map[string]string{
+			AuthURLAnnotation:             auth.URL,
+			AuthRequestHeadersAnnotation:  "Cookie",
+			AuthResponseHeadersAnnotation: "X-Auth-User",
+			AuthCacheTTLAnnotation:        "1m",
+		})
+		calls.Store(0)
+		for i := 0; i < 3; i++ {
+			w := do(s, "GET", "session=alice")
+			assert.Equal(t, "GET alice", w.Body.String())
+		}
+		assert.Equal(t, int32(1), calls.Load(), "results should be cached")
+
+		w := do(s, "GET", "session=mallory")
+		assert.Equal(t, http.StatusForbidden, w.Code, "results should be cached per credentials")
+		assert.Equal(t, int32(2), calls.Load())
+
+		for i := 0; i < 2; i++ {
+			do(s, "GET", "session=broken")
+		}
+		assert.Equal(t, int32(4), calls.Load(), "server errors should not be cached")
+	})
+}
+
+func TestForwardAuthCacheKey(t *testing.T) {
+	fa := &forwardAuth{requestHeaders: []string{"A", "B"}}
+	key := func(header http.Header) [32]byte {
+		r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+		r.Header = header
+		return fa.cacheKey(r)
+	}
+
+	assert.Equal(t, key(http.Header{"A": {"1"}}), key(http.Header{"A": {"1"}, "C": {"2"}}), "other headers should be ignored")
+	assert.NotEqual(t, key(http.Header{"A": {"B"}}), key(http.Header{"B": {"B"}}), "values should not move between headers")
+	assert.NotEqual(t, key(http.Header{"A": {"1", "2"}}), key(http.Header{"A": {"1"}, "B": {"2"}}))
+	assert.NotEqual(t, key(http.Header{"X-Real-Ip": {"10.0.0.1"}}), key(http.Header{"X-Real-Ip": {"10.0.0.2"}}),
+		"results should not be shared between clients")
+	assert.NotEqual(t, key(http.Header{"X-Forwarded-For": {"10.0.0.1"}}), key(http.Header{"X-Forwarded-For": {"10.0.0.2"}}),
+		"results should not be shared between clients")
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The headers describing how a request reached the controller.
+const (
+	headerForwarded       = "Forwarded"
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedProto = "X-Forwarded-Proto"
+	headerXForwardedHost  = "X-Forwarded-Host"
+	headerXForwardedPort  = "X-Forwarded-Port"
+	headerXRealIP         = "X-Real-Ip"
+)
+
+type clientIPContextKey struct{}
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or IP addresses of trusted proxies.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range splitList(s) {
+		network, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// setForwardedHeaders determines the client IP of the request and sets the forwarded headers sent to
+// backends. Forwarded headers are only believed when the peer is a trusted proxy, otherwise they are
+// removed so that clients can't spoof them.
+func setForwardedHeaders(r *http.Request, trustedProxies []*net.IPNet) *http.Request {
+	peer := remoteIP(r)
+	trusted := peer != nil && containsIP(trustedProxies, peer)
+
+	h := r.Header
+	proto, host, port := h.Get(headerXForwardedProto), h.Get(headerXForwardedHost), h.Get(headerXForwardedPort)
+	client := peer
+	if trusted {
+		client = forwardedClientIP(h, peer, trustedProxies)
+	} else {
+		h.Del(headerForwarded)
+		h.Del(headerXForwardedFor)
+		proto, host, port = "", "", ""
+	}
+
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	if port == "" {
+		port = localPort(r, proto)
+	}
+	h.Set(headerXForwardedProto, proto)
+	h.Set(headerXForwardedHost, host)
+	h.Set(headerXForwardedPort, port)
+
+	if peer != nil {
+		// the reverse proxy appends the peer to X-Forwarded-For
+		h.Add(headerForwarded, "for="+forwardedNode(peer)+";host="+strconv.Quote(r.Host)+";proto="+proto)
+	}
+	if client == nil {
+		h.Del(headerXRealIP)
+		return r
+	}
+	h.Set(headerXRealIP, client.String())
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, client))
+}
+
+// forwardedClientIP returns the client IP from the Forwarded or X-Forwarded-For headers. The chain of
+// proxies is walked from the peer backwards, and the first address that isn't a trusted proxy is the
+// client.
+func forwardedClientIP(h http.Header, peer net.IP, trustedProxies []*net.IPNet) net.IP {
+	var chain []string
+	if values := h.Values(headerForwarded); len(values) > 0 {
+		chain = parseForwardedFor(values)
+	} else {
+		for _, v := range h.Values(headerXForwardedFor) {
+			for _, addr := range strings.Split(v, ",") {
+				chain = append(chain, strings.TrimSpace(addr))
+			}
+		}
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseNodeIP(chain[i])
+		if ip == nil {
+			// an obfuscated or invalid address, so the last trusted proxy is as far as we can go
+			break
+		}
+		client = ip
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseForwardedFor returns the for= parameters of RFC 7239 Forwarded headers.
+func parseForwardedFor(values []string) []string {
+	var nodes []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			node := ""
+			for _, pair := range strings.Split(element, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					node = strings.Trim(v, `"`)
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// parseNodeIP parses an address from X-Forwarded-For or a Forwarded node, which may include a port
+// and brackets around IPv6 addresses.
+func parseNodeIP(node string) net.IP {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+// forwardedNode formats an IP address as a Forwarded node.
+func forwardedNode(ip net.IP) string {
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// localPort returns the port the request was received on.
+func localPort(r *http.Request, proto string) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// remoteIP returns the IP address of the peer that sent the request.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the IP address of the client that sent the request, which is the peer unless the
+// request came through a trusted proxy.
+func clientIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
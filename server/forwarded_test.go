@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	newRequest := func(remoteAddr string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		r.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		r := newRequest("203.0.113.1:1234", map[string]string{
+			"X-Forwarded-For":   "1.2.3.4",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "evil.example.com",
+			"Forwarded":         "for=1.2.3.4",
+			"X-Real-Ip":         "1.2.3.4",
+		})
+		r = setForwardedHeaders(r, trusted)
+		assert.Equal(t, net.ParseIP("203.0.113.1"), clientIP(r))
+		assert.Empty(t, r.Header.Values("X-Forwarded-For"), "spoofed headers should be removed")
+		assert.Equal(t, "http", r.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "www.example.com", r.Header.Get("X-Forwarded-Host"))
+		assert.Equal(t, "80", r.Header.Get("X-Forwarded-Port"))
+		assert.Equal(t, []string{`for=203.0.113.1;host="www.example.com";proto=http`}, r.Header.Values("Forwarded"))
+		assert.Equal(t, "203.0.113.1", r.Header.Get("X-Real-Ip"))
+	})
+	t.Run("trusted peer", func(t *testing.T) {
+		r := newRequest("10.0.0.1:1234", map[string]string{
+			"X-Forwarded-For":   "1.2.3.4, 203.0.113.9, 192.168.1.1",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.example.com",
+			"X-Forwarded-Port":  "443",
+		})
+		r = setForwardedHeaders(r, trusted)
+		assert.Equal(t, net.ParseIP("203.0.113.9"), clientIP(r), "the last untrusted address should be the client")
+		assert.Equal(t, "1.2.3.4, 203.0.113.9, 192.168.1.1", r.Header.Get("X-Forwarded-For"))
+		assert.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "443", r.Header.Get("X-Forwarded-Port"))
+	})
+	t.Run("rfc 7239", func(t *testing.T) {
+		r := newRequest("10.0.0.1:1234", map[string]string{
+			"Forwarded":       `for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`,
+			"X-Forwarded-For": "1.2.3.4",
+		})
+		r = setForwardedHeaders(r, trusted)
+		assert.Equal(t, net.ParseIP("2001:db8::1"), clientIP(r), "Forwarded should take precedence")
+
+		r = newRequest("10.0.0.1:1234", map[string]string{"Forwarded": `for=_hidden, for=10.0.0.2`})
+		r = setForwardedHeaders(r, trusted)
+		assert.Equal(t, net.ParseIP("10.0.0.2"), clientIP(r), "obfuscated addresses should stop the walk")
+	})
+	t.Run("tls", func(t *testing.T) {
+		r := newRequest("[2001:db8::2]:1234", nil)
+		r.TLS = new(tls.ConnectionState)
+		r.Host = "www.example.com:8443"
+		r = setForwardedHeaders(r, trusted)
+		assert.Equal(t, "https", r.Header.Get("X-Forwarded-Proto"))
+		assert.Equal(t, "8443", r.Header.Get("X-Forwarded-Port"))
+		assert.Equal(t, `for="[2001:db8::2]";host="www.example.com:8443";proto=https`, r.Header.Get("Forwarded"))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseTrustedProxies("10.0.0.0/8,nope")
+		assert.Error(t, err)
+	})
+}
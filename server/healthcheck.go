@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// healthCheck configures the active health checks of a backend's endpoints.
+type healthCheck struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+func parseHealthCheck(path, interval, timeout, healthyThreshold, unhealthyThreshold string) (*healthCheck, error) {
+	hc := &healthCheck{
+		path:               path,
+		interval:           time.Second * 10,
+		timeout:            time.Second * 2,
+		healthyThreshold:   2,
+		unhealthyThreshold: 3,
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid path: %s", path)
+	}
+
+	var err error
+	if interval != "" {
+		if hc.interval, err = parseDuration(interval); err != nil {
+			return nil, fmt.Errorf("invalid interval: %w", err)
+		}
+	}
+	if timeout != "" {
+		if hc.timeout, err = parseDuration(timeout); err != nil {
+			return nil, fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+	for _, threshold := range []struct {
+		name  string
+		value string
+		dst   *int
+	}{
+		{"healthy threshold", healthyThreshold, &hc.healthyThreshold},
+		{"unhealthy threshold", unhealthyThreshold, &hc.unhealthyThreshold},
+	} {
+		if threshold.value == "" {
+			continue
+		}
+		if *threshold.dst, err = strconv.Atoi(threshold.value); err != nil || *threshold.dst <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", threshold.name, threshold.value)
+		}
+	}
+	return hc, nil
+}
+
+// runHealthChecks probes the backend's endpoints until the context is canceled. The service address
+// used without any known endpoints isn't probed.
+func (bp *backendProxy) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(bp.opts.healthCheck.interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, endpoint := range bp.transport.endpoints.Load().([]string) {
+			wg.Add(1)
+			go func(endpoint string) {
+				defer wg.Done()
+				bp.transport.recordHealthCheck(endpoint, bp.opts.healthCheck, bp.probe(ctx, endpoint))
+			}(endpoint)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe returns true if the endpoint responds to the health check with a 2xx or 3xx status.
+func (bp *backendProxy) probe(ctx context.Context, endpoint string) bool {
+	hc := bp.opts.healthCheck
+	ctx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	u := &url.URL{Scheme: bp.url.Scheme, Host: endpoint}
+	u, err := u.Parse(hc.path)
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return false
+	}
+	req.Host = bp.url.Host
+	req.Header.Set("User-Agent", "kubernetes-simple-ingress-controller/health-check")
+
+	res, err := bp.transport.next.RoundTrip(req)
+	if err != nil {
+		log.Debug().Err(err).Str("backend", bp.url.String()).Str("endpoint", endpoint).Msg("health check failed")
+		return false
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+	_ = res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+// recordHealthCheck records the result of an active health check of an endpoint.
+func (t *endpointTransport) recordHealthCheck(endpoint string, hc *healthCheck, ok bool) {
+	t.mu.Lock()
+	changed := t.getHealth(endpoint).recordCheck(hc, ok)
+	t.mu.Unlock()
+
+	if changed {
+		event := log.Info()
+		if !ok {
+			event = log.Warn()
+		}
+		event.Str("backend", t.host).Str("endpoint", endpoint).Bool("healthy", ok).Msg("endpoint health changed")
+	}
+}
+
+// recordCheck records the result of a health check and returns true if the endpoint's health changed.
+func (h *endpointHealth) recordCheck(hc *healthCheck, ok bool) bool {
+	if ok {
+		h.checkFailures = 0
+		h.checkSuccesses++
+		if h.unhealthy && h.checkSuccesses >= hc.healthyThreshold {
+			h.unhealthy = false
+			return true
+		}
+		return false
+	}
+
+	h.checkSuccesses = 0
+	h.checkFailures++
+	if !h.unhealthy && h.checkFailures >= hc.unhealthyThreshold {
+		h.unhealthy = true
+		return true
+	}
+	return false
+}
+
+// An EndpointStatus describes the health of a backend endpoint.
+type EndpointStatus struct {
+	Address string `json:"address"`
+	// Healthy is false when the endpoint fails its active health checks.
+	Healthy bool `json:"healthy"`
+	// EjectedUntil is set while the endpoint is ejected by outlier detection.
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+}
+
+// A BackendStatus describes the endpoints of a backend.
+type BackendStatus struct {
+	Namespace string           `json:"namespace"`
+	Ingress   string           `json:"ingress"`
+	URL       string           `json:"url"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+	// Circuit is the state of the backend's circuit breaker if it opens on failures.
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// endpointStatuses returns the status of every endpoint of the backend.
+func (t *endpointTransport) endpointStatuses(now time.Time) []EndpointStatus {
+	endpoints := t.getEndpoints()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	statuses := make([]EndpointStatus, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		status := EndpointStatus{Address: endpoint, Healthy: true}
+		if h, ok := t.health[endpoint]; ok {
+			status.Healthy = !h.unhealthy
+			if now.Before(h.ejectedUntil) {
+				ejectedUntil := h.ejectedUntil
+				status.EjectedUntil = &ejectedUntil
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// backendStatuses returns the status of every backend in the routing table.
+func (rt *RoutingTable) backendStatuses() []BackendStatus {
+	now := time.Now()
+	statuses := make([]BackendStatus, 0, len(rt.proxies))
+	for _, bp := range rt.proxies {
+		statuses = append(statuses, BackendStatus{
+			Namespace: bp.namespace,
+			Ingress:   bp.ingress,
+			URL:       bp.url.String(),
+			Endpoints: bp.transport.endpointStatuses(now),
+			Circuit:   bp.breaker.getState(),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Ingress != b.Ingress {
+			return a.Ingress < b.Ingress
+		}
+		return a.URL < b.URL
+	})
+	return statuses
+}
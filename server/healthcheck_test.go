@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/stretchr/testify/assert"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestHealthChecks(t *testing.T) {
+	var healthy int32 = 1
+	var requests int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if atomic.LoadInt32(&healthy) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer flaky.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer stable.Close()
+
+	s := New()
+	s.Update(&watcher.Payload{
+		Ingresses: []watcher.IngressPayload{{
+			Ingress: &networking.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "example",
+					Annotations: map[string]string{
+						HealthCheckPathAnnotation:               "/healthz",
+						HealthCheckIntervalAnnotation:           "10ms",
+						HealthCheckHealthyThresholdAnnotation:   "1",
+						HealthCheckUnhealthyThresholdAnnotation: "1",
+					},
+				},
+				Spec: networking.IngressSpec{
+					DefaultBackend: &networking.IngressBackend{
+						Service: &networking.IngressServiceBackend{
+							Name: "example",
+							Port: networking.ServiceBackendPort{Number: 80},
+						},
+					},
+					Rules: []networking.IngressRule{{Host: "www.example.com"}},
+				},
+			},
+			ServicePorts:     map[string]map[string]int{"example": {"http": 80}},
+			ServiceEndpoints: map[string]map[string][]string{"example": {"http": {hostOf(flaky), hostOf(stable)}}},
+		}},
+	})
+	defer s.Update(nil)
+
+	getStatuses := func() []BackendStatus {
+		w := httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/backends", nil))
+		var statuses []BackendStatus
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &statuses))
+		return statuses
+	}
+	isHealthy := func(endpoint string) bool {
+		for _, status := range getStatuses() {
+			for _, e := range status.Endpoints {
+				if e.Address == endpoint {
+					return e.Healthy
+				}
+			}
+		}
+		t.Fatalf("endpoint %s not found", endpoint)
+		return false
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	assert.Eventually(t, func() bool { return !isHealthy(hostOf(flaky)) }, time.Second, time.Millisecond*10)
+
+	before := atomic.LoadInt32(&requests)
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, before, atomic.LoadInt32(&requests), "unhealthy endpoints should not receive requests")
+
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, w.Body.String(), `simple_ingress_backend_endpoint_healthy{backend="http://example:80",endpoint="`+
+		hostOf(flaky)+`",ingress="example",namespace="default"} 0`)
+
+	atomic.StoreInt32(&healthy, 1)
+	assert.Eventually(t, func() bool { return isHealthy(hostOf(flaky)) }, time.Second, time.Millisecond*10)
+}
+
+func TestHealthChecksProbeEndpoints(t *testing.T) {
+	var serviceProbes, endpointProbes int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&serviceProbes, 1)
+	}))
+	defer service.Close()
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&endpointProbes, 1)
+	}))
+	defer endpoint.Close()
+
+	hc, _ := parseHealthCheck("/healthz", "10ms", "", "", "")
+	u, _ := url.Parse(service.URL)
+	bp := newBackendProxy(defaultConfig(), "", u, &ingressOptions{
+		backendProtocol: BackendProtocolHTTP,
+		healthCheck:     hc,
+	})
+	defer bp.close()
+
+	time.Sleep(time.Millisecond * 30)
+	bp.setEndpoints(nil)
+	time.Sleep(time.Millisecond * 30)
+	bp.setEndpoints([]string{hostOf(endpoint)})
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&endpointProbes) > 0 }, time.Second, time.Millisecond*10)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&serviceProbes), "the service address should not be probed")
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	hc, err := parseHealthCheck("/healthz", "", "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &healthCheck{
+			path:               "/healthz",
+			interval:           time.Second * 10,
+			timeout:            time.Second * 2,
+			healthyThreshold:   2,
+			unhealthyThreshold: 3,
+		}, hc)
+	}
+	_, err = parseHealthCheck("healthz", "", "", "", "")
+	assert.Error(t, err)
+	_, err = parseHealthCheck("/healthz", "", "", "0", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestPayload returns a payload with an ingress routing /a and /b on www.example.com to the example
+// service, whose ready endpoints are the given addresses.
+func newTestPayload(annotations map[string]string, endpoints ...string) *watcher.Payload {
+	backend := networking.IngressBackend{
+		Service: &networking.IngressServiceBackend{
+			Name: "example",
+			Port: networking.ServiceBackendPort{Number: 80},
+		},
+	}
+	return &watcher.Payload{
+		Ingresses: []watcher.IngressPayload{{
+			Ingress: &networking.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example", Annotations: annotations},
+				Spec: networking.IngressSpec{
+					Rules: []networking.IngressRule{{
+						Host: "www.example.com",
+						IngressRuleValue: networking.IngressRuleValue{
+							HTTP: &networking.HTTPIngressRuleValue{
+								Paths: []networking.HTTPIngressPath{
+									{Path: "^/a", Backend: backend},
+									{Path: "^/b", Backend: backend},
+								},
+							},
+						},
+					}},
+				},
+			},
+			ServicePorts:     map[string]map[string]int{"example": {"http": 80}},
+			ServiceEndpoints: map[string]map[string][]string{"example": {"http": endpoints}},
+		}},
+	}
+}
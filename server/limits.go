@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A limitListener caps the number of open connections accepted by a listener. Connections beyond the
+// cap wait up to the queue timeout for another connection to close and are then dropped.
+type limitListener struct {
+	net.Listener
+	name    string
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+func newLimitListener(li net.Listener, name string, max int, timeout time.Duration) net.Listener {
+	if max <= 0 {
+		return li
+	}
+	return &limitListener{
+		Listener: li,
+		name:     name,
+		sem:      make(chan struct{}, max),
+		timeout:  timeout,
+	}
+}
+
+func (li *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := li.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if acquire(context.Background(), li.sem, li.timeout) {
+			return &limitedConn{Conn: conn, release: func() { <-li.sem }}, nil
+		}
+		log.Warn().Str("listener", li.name).Str("remote_addr", peerAddr(conn).String()).
+			Msg("too many connections, dropping connection")
+		_ = conn.Close()
+	}
+}
+
+// A limitedConn releases its slot in the connection limit when closed.
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// acquire acquires a slot in the semaphore, waiting up to the timeout for one to be released.
+func acquire(ctx context.Context, sem chan struct{}, timeout time.Duration) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// concurrencyOptions cap the concurrent in-flight requests of an ingress.
+type concurrencyOptions struct {
+	maxRequests  int
+	queueTimeout time.Duration
+}
+
+func parseConcurrency(maxRequests, queueTimeout string) (*concurrencyOptions, error) {
+	opts := new(concurrencyOptions)
+	var err error
+	if opts.maxRequests, err = strconv.Atoi(maxRequests); err != nil || opts.maxRequests <= 0 {
+		return nil, fmt.Errorf("invalid max requests: %s", maxRequests)
+	}
+	if queueTimeout != "" {
+		if opts.queueTimeout, err = parseDuration(queueTimeout); err != nil {
+			return nil, fmt.Errorf("invalid queue timeout: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// A concurrencyLimiter caps the concurrent in-flight requests of an ingress. Requests beyond the cap
+// are queued for up to the queue timeout and then rejected.
+type concurrencyLimiter struct {
+	opts *concurrencyOptions
+	sem  chan struct{}
+}
+
+func newConcurrencyLimiter(opts *concurrencyOptions) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		opts: opts,
+		sem:  make(chan struct{}, opts.maxRequests),
+	}
+}
+
+// acquire returns false if the request should be rejected. Otherwise release must be called once the
+// request completes.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	return acquire(ctx, l.sem, l.opts.queueTimeout)
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.sem
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitListener(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	li = newLimitListener(li, "test", 1, time.Millisecond*50)
+	defer li.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := li.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	c1, err := net.Dial("tcp", li.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c1.Close()
+	s1 := <-accepted
+
+	c2, err := net.Dial("tcp", li.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c2.Close()
+	_ = c2.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c2.Read(make([]byte, 1))
+	assert.Error(t, err, "connections beyond the limit should be dropped")
+
+	c3, err := net.Dial("tcp", li.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c3.Close()
+	time.Sleep(time.Millisecond * 10)
+	s1.Close()
+	select {
+	case s3 := <-accepted:
+		s3.Close()
+	case <-time.After(time.Second):
+		t.Error("queued connections should be accepted once a slot is free")
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	started, done := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-done
+	}))
+	defer backend.Close()
+
+	s := New()
+	s.Update(newTestPayload(map[string]string{
+		MaxConcurrentRequestsAnnotation:             "1",
+		MaxConcurrentRequestsQueueTimeoutAnnotation: "50ms",
+	}, hostOf(backend)))
+	get := func() int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/a", nil))
+		return w.Code
+	}
+
+	first := make(chan int)
+	go func() { first <- get() }()
+	<-started
+
+	start := time.Now()
+	assert.Equal(t, http.StatusServiceUnavailable, get())
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*50, "requests should be queued")
+
+	second := make(chan int)
+	go func() { second <- get() }()
+	time.Sleep(time.Millisecond * 10)
+	done <- struct{}{}
+	<-started
+	close(done)
+	assert.Equal(t, http.StatusOK, <-first)
+	assert.Equal(t, http.StatusOK, <-second, "queued requests should proceed once a slot is free")
+}
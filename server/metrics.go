@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "simple_ingress"
+
+// metrics holds the prometheus metrics exported by the server.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests             *prometheus.CounterVec
+	requestDuration      *prometheus.HistogramVec
+	upstreamDuration     *prometheus.HistogramVec
+	upstreamErrors       *prometheus.CounterVec
+	activeConnections    *prometheus.GaugeVec
+	tlsHandshakeErrors   prometheus.Counter
+	routingTableRebuilds prometheus.Histogram
+	watcherEvents        *prometheus.CounterVec
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "The number of requests served.",
+		}, []string{"ingress", "host", "path", "method", "status_class"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "The time taken to serve requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"ingress", "host", "path", "method", "status_class"}),
+		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "upstream",
+			Name:      "response_duration_seconds",
+			Help:      "The time taken by backends to respond with headers.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"ingress", "backend"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "upstream",
+			Name:      "errors_total",
+			Help:      "The number of requests that failed because of a backend.",
+		}, []string{"ingress", "backend", "reason"}),
+		activeConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_connections",
+			Help:      "The number of open client connections.",
+		}, []string{"listener"}),
+		tlsHandshakeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tls_handshake_errors_total",
+			Help:      "The number of failed TLS handshakes with clients.",
+		}),
+		routingTableRebuilds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "routing_table",
+			Name:      "rebuild_duration_seconds",
+			Help:      "The time taken to rebuild the routing table.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}),
+		watcherEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "watcher",
+			Name:      "events_total",
+			Help:      "The number of kubernetes resource events seen by the watcher.",
+		}, []string{"resource", "event"}),
+	}
+	m.registry.MustRegister(
+		&certificateCollector{s: s},
+		&backendCollector{s: s},
+		m.requests,
+		m.requestDuration,
+		m.upstreamDuration,
+		m.upstreamErrors,
+		m.activeConnections,
+		m.tlsHandshakeErrors,
+		m.routingTableRebuilds,
+		m.watcherEvents,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeRequest records the metrics of a completed request.
+func (m *metrics) observeRequest(r *http.Request, status int, info *requestInfo) {
+	var ingress, host, path, backend string
+	if info.backend != nil {
+		ingress, host, path = info.ingress(), info.backend.host, info.backend.path()
+		backend = info.backend.url.String()
+	}
+	m.requests.WithLabelValues(ingress, host, path, metricsMethod(r.Method), statusClass(status)).Inc()
+	m.requestDuration.WithLabelValues(ingress, host, path, metricsMethod(r.Method), statusClass(status)).
+		Observe(time.Since(info.start).Seconds())
+	if info.upstreamAddr != "" {
+		m.upstreamDuration.WithLabelValues(ingress, backend).Observe(info.upstreamLatency.Seconds())
+	}
+	if info.upstreamError != "" {
+		m.upstreamErrors.WithLabelValues(ingress, backend, info.upstreamError).Inc()
+	}
+}
+
+// trackConnections returns a connection state hook that tracks the open connections of a listener.
+func (m *metrics) trackConnections(listener string) func(net.Conn, http.ConnState) {
+	gauge := m.activeConnections.WithLabelValues(listener)
+	return func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			gauge.Inc()
+		case http.StateHijacked, http.StateClosed:
+			gauge.Dec()
+		}
+	}
+}
+
+// trackHandshake counts a handshake as failed unless cfg verifies the connection before the
+// handshake's context ends. crypto/tls calls VerifyConnection for every successful handshake,
+// including resumed ones, and the context lives as long as the connection. Handshakes that fail
+// before the client hello has been read aren't counted.
+func (m *metrics) trackHandshake(ctx context.Context, cfg *tls.Config) {
+	var verified atomic.Bool
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(cs); err != nil {
+				return err
+			}
+		}
+		verified.Store(true)
+		return nil
+	}
+	context.AfterFunc(ctx, func() {
+		if !verified.Load() {
+			m.tlsHandshakeErrors.Inc()
+		}
+	})
+}
+
+// metricsMethod limits the methods used as label values so that clients can't create arbitrarily
+// many series.
+func metricsMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE":
+		return method
+	}
+	return "OTHER"
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+var (
+	certificateExpiryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "certificate", "expiry_timestamp_seconds"),
+		"The time at which a certificate expires.",
+		[]string{"namespace", "ingress", "secret", "subject", "issuer", "dns_names"}, nil,
+	)
+	certificateUncoveredHostsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "certificate", "uncovered_hosts"),
+		"The number of ingress TLS hosts not covered by a certificate.",
+		[]string{"namespace", "ingress", "secret"}, nil,
+	)
+)
+
+// A certificateCollector collects metrics about the certificates in the current routing table.
+type certificateCollector struct {
+	s *Server
+}
+
+func (c *certificateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificateExpiryDesc
+	ch <- certificateUncoveredHostsDesc
+}
+
+func (c *certificateCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range mergeCertificateStatuses(c.s.routingTable.Load().(*RoutingTable).certificateStatuses) {
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue,
+			float64(status.NotAfter.Unix()),
+			status.Namespace, status.Ingress, status.SecretName, status.Subject, status.Issuer,
+			strings.Join(status.DNSNames, ","))
+		ch <- prometheus.MustNewConstMetric(certificateUncoveredHostsDesc, prometheus.GaugeValue,
+			float64(len(status.UncoveredHosts)),
+			status.Namespace, status.Ingress, status.SecretName)
+	}
+}
+
+// mergeCertificateStatuses merges the statuses of TLS entries of an ingress referencing the same secret,
+// which would otherwise be collected as duplicate metrics.
+func mergeCertificateStatuses(statuses []watcher.CertificateStatus) []watcher.CertificateStatus {
+	var merged []watcher.CertificateStatus
+	indices := make(map[[3]string]int)
+	for _, status := range statuses {
+		key := [3]string{status.Namespace, status.Ingress, status.SecretName}
+		i, ok := indices[key]
+		if !ok {
+			indices[key] = len(merged)
+			status.UncoveredHosts = slices.Clone(status.UncoveredHosts)
+			merged = append(merged, status)
+			continue
+		}
+		for _, host := range status.UncoveredHosts {
+			if !slices.Contains(merged[i].UncoveredHosts, host) {
+				merged[i].UncoveredHosts = append(merged[i].UncoveredHosts, host)
+			}
+		}
+	}
+	return merged
+}
+
+var (
+	backendEndpointHealthyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "backend", "endpoint_healthy"),
+		"Whether a backend endpoint passes its health checks (1) or not (0).",
+		[]string{"namespace", "ingress", "backend", "endpoint"}, nil,
+	)
+	backendEndpointEjectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "backend", "endpoint_ejected"),
+		"Whether a backend endpoint is ejected by outlier detection (1) or not (0).",
+		[]string{"namespace", "ingress", "backend", "endpoint"}, nil,
+	)
+)
+
+// A backendCollector collects metrics about the backends in the current routing table.
+type backendCollector struct {
+	s *Server
+}
+
+func (c *backendCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendEndpointHealthyDesc
+	ch <- backendEndpointEjectedDesc
+}
+
+func (c *backendCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, status := range c.s.routingTable.Load().(*RoutingTable).backendStatuses() {
+		for _, endpoint := range status.Endpoints {
+			ch <- prometheus.MustNewConstMetric(backendEndpointHealthyDesc, prometheus.GaugeValue,
+				boolToFloat(endpoint.Healthy),
+				status.Namespace, status.Ingress, status.URL, endpoint.Address)
+			ch <- prometheus.MustNewConstMetric(backendEndpointEjectedDesc, prometheus.GaugeValue,
+				boolToFloat(endpoint.EjectedUntil != nil),
+				status.Namespace, status.Ingress, status.URL, endpoint.Address)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	s := New()
+	s.Update(newTestPayload(nil, hostOf(backend)))
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.example.com/a", nil))
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "http://unknown.example.com/", nil))
+	s.ObserveWatcherEvent("ingresses", "add")
+
+	hook := s.metrics.trackConnections("secure")
+	hook(nil, http.StateNew)
+	hook(nil, http.StateNew)
+	hook(nil, http.StateClosed)
+
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, expect := range []string{
+		`simple_ingress_requests_total{host="www.example.com",ingress="default/example",method="GET",path="^/a",status_class="2xx"} 1`,
+		`simple_ingress_requests_total{host="",ingress="",method="OTHER",path="",status_class="4xx"} 1`,
+		`simple_ingress_request_duration_seconds_count{host="www.example.com",ingress="default/example",method="GET",path="^/a",status_class="2xx"} 1`,
+		`simple_ingress_upstream_response_duration_seconds_count{`,
+		`simple_ingress_active_connections{listener="secure"} 1`,
+		`simple_ingress_tls_handshake_errors_total 0`,
+		`simple_ingress_routing_table_rebuild_duration_seconds_count 1`,
+		`simple_ingress_watcher_events_total{event="add",resource="ingresses"} 1`,
+	} {
+		assert.Contains(t, body, expect)
+	}
+
+	t.Run("upstream errors", func(t *testing.T) {
+		s.Update(newTestPayload(nil, "127.0.0.1:1"))
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/a", nil))
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+
+		w = httptest.NewRecorder()
+		s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		var found bool
+		for _, ln := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(ln, "simple_ingress_upstream_errors_total{") && strings.Contains(ln, `reason="error"`) {
+				found = true
+			}
+		}
+		assert.True(t, found, "upstream errors should be counted")
+	})
+}
+
+func TestStatusClass(t *testing.T) {
+	assert.Equal(t, "2xx", statusClass(200))
+	assert.Equal(t, "5xx", statusClass(503))
+	assert.Equal(t, "GET", metricsMethod("GET"))
+	assert.Equal(t, "OTHER", metricsMethod("get"))
+}
+
+func TestCertificateMetrics(t *testing.T) {
+	status := watcher.CertificateStatus{
+		Namespace:      "default",
+		Ingress:        "example",
+		SecretName:     "example-tls",
+		NotAfter:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		UncoveredHosts: []string{"api.example.com"},
+	}
+	other := status
+	other.UncoveredHosts = []string{"api.example.com", "admin.example.com"}
+
+	s := New()
+	s.Update(&watcher.Payload{Certificates: []watcher.CertificateStatus{status, other}})
+	w := httptest.NewRecorder()
+	s.adminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "TLS entries sharing a secret should not break the scrape")
+	assert.Contains(t, w.Body.String(), `simple_ingress_certificate_uncovered_hosts{ingress="example",namespace="default",secret="example-tls"} 2`)
+	assert.Equal(t, []string{"api.example.com"}, status.UncoveredHosts, "statuses should not be modified")
+}
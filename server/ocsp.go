@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+const maxOCSPResponseSize = 1 << 20
+
+// An ocspStapler fetches and caches OCSP responses for the certificates in the routing table.
+type ocspStapler struct {
+	responderURL string
+	interval     time.Duration
+	client       *http.Client
+
+	refresh chan struct{}
+
+	mu        sync.RWMutex
+	responses map[[sha256.Size]byte]*ocsp.Response
+}
+
+func newOCSPStapler(responderURL string, interval time.Duration) *ocspStapler {
+	return &ocspStapler{
+		responderURL: responderURL,
+		interval:     interval,
+		client:       &http.Client{Timeout: time.Second * 10},
+		refresh:      make(chan struct{}, 1),
+		responses:    make(map[[sha256.Size]byte]*ocsp.Response),
+	}
+}
+
+// Run periodically refreshes the OCSP responses for the certificates returned by getCertificates.
+func (st *ocspStapler) Run(ctx context.Context, getCertificates func() []*tls.Certificate) {
+	ticker := time.NewTicker(st.interval)
+	defer ticker.Stop()
+
+	for {
+		st.update(ctx, getCertificates())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-st.refresh:
+		}
+	}
+}
+
+// Refresh triggers a refresh of the OCSP responses, typically because the certificates changed.
+func (st *ocspStapler) Refresh() {
+	select {
+	case st.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Staple returns the certificate with its OCSP response attached. If there is no valid response,
+// the certificate is returned as-is.
+func (st *ocspStapler) Staple(cert *tls.Certificate) *tls.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return cert
+	}
+
+	st.mu.RLock()
+	res, ok := st.responses[sha256.Sum256(cert.Certificate[0])]
+	st.mu.RUnlock()
+	if !ok || !isOCSPResponseValid(res, time.Now()) {
+		return cert
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = res.Raw
+	return &stapled
+}
+
+func (st *ocspStapler) update(ctx context.Context, certs []*tls.Certificate) {
+	now := time.Now()
+
+	st.mu.RLock()
+	existing := st.responses
+	st.mu.RUnlock()
+
+	responses := make(map[[sha256.Size]byte]*ocsp.Response, len(certs))
+	for _, cert := range certs {
+		if len(cert.Certificate) < 2 {
+			// without the issuer we can't build an OCSP request
+			continue
+		}
+		key := sha256.Sum256(cert.Certificate[0])
+		if _, ok := responses[key]; ok {
+			continue
+		}
+
+		res := existing[key]
+		if res == nil || needsOCSPRefresh(res, now) {
+			fetched, err := st.fetch(ctx, cert)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to fetch ocsp response")
+			} else {
+				res = fetched
+			}
+		}
+
+		// drop expired responses so that we stop stapling when the responder is unreachable
+		if res != nil && isOCSPResponseValid(res, now) {
+			responses[key] = res
+		}
+	}
+
+	st.mu.Lock()
+	st.responses = responses
+	st.mu.Unlock()
+}
+
+func (st *ocspStapler) fetch(ctx context.Context, cert *tls.Certificate) (*ocsp.Response, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer certificate: %w", err)
+	}
+
+	responderURL := st.responderURL
+	if responderURL == "" {
+		if len(leaf.OCSPServer) == 0 {
+			return nil, fmt.Errorf("no ocsp responder for %s", leaf.Subject)
+		}
+		responderURL = leaf.OCSPServer[0]
+	}
+
+	body, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, fmt.Errorf("error creating ocsp request: %w", err)
+	}
+	req, err := http.NewRequest("POST", responderURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ocsp request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	res, err := st.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error contacting ocsp responder: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from ocsp responder: %d", res.StatusCode)
+	}
+	raw, err := io.ReadAll(http.MaxBytesReader(nil, res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading ocsp response: %w", err)
+	}
+
+	ocspRes, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ocsp response: %w", err)
+	}
+	switch ocspRes.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		log.Warn().Str("subject", leaf.Subject.String()).Time("revoked-at", ocspRes.RevokedAt).Msg("certificate has been revoked")
+	default:
+		return nil, errors.New("ocsp responder returned an unknown status")
+	}
+	return ocspRes, nil
+}
+
+// needsOCSPRefresh returns true once half of the response's validity period has elapsed.
+func needsOCSPRefresh(res *ocsp.Response, now time.Time) bool {
+	if res.NextUpdate.IsZero() {
+		return true
+	}
+	return now.After(res.ThisUpdate.Add(res.NextUpdate.Sub(res.ThisUpdate) / 2))
+}
+
+func isOCSPResponseValid(res *ocsp.Response, now time.Time) bool {
+	return res.NextUpdate.IsZero() || now.Before(res.NextUpdate)
+}
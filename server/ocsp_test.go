@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapler(t *testing.T) {
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	leaf := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	})
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.cert.Raw, ca.cert.Raw},
+		PrivateKey:  leaf.key,
+	}
+
+	var available int32 = 1
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if !assert.NoError(t, err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, ca.key)
+		if !assert.NoError(t, err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(res)
+	}))
+	defer responder.Close()
+
+	st := newOCSPStapler(responder.URL, time.Minute)
+	assert.Nil(t, st.Staple(cert).OCSPStaple, "nothing should be stapled before the first update")
+
+	st.update(context.Background(), []*tls.Certificate{cert})
+	stapled := st.Staple(cert)
+	if assert.NotNil(t, stapled.OCSPStaple) {
+		res, err := ocsp.ParseResponse(stapled.OCSPStaple, ca.cert)
+		assert.NoError(t, err)
+		assert.Equal(t, leaf.cert.SerialNumber, res.SerialNumber)
+	}
+	assert.Nil(t, cert.OCSPStaple, "the original certificate should not be modified")
+
+	// responses are kept when the responder is down, until they expire
+	atomic.StoreInt32(&available, 0)
+	st.mu.Lock()
+	for _, res := range st.responses {
+		res.ThisUpdate = time.Now().Add(-time.Hour)
+		res.NextUpdate = time.Now().Add(time.Minute)
+	}
+	st.mu.Unlock()
+	st.update(context.Background(), []*tls.Certificate{cert})
+	assert.NotNil(t, st.Staple(cert).OCSPStaple)
+
+	st.mu.Lock()
+	for _, res := range st.responses {
+		res.NextUpdate = time.Now().Add(-time.Second)
+	}
+	st.mu.Unlock()
+	assert.Nil(t, st.Staple(cert).OCSPStaple, "expired responses should not be stapled")
+	st.update(context.Background(), []*tls.Certificate{cert})
+	assert.Empty(t, st.responses)
+
+	// certificates without an issuer are skipped
+	st.update(context.Background(), []*tls.Certificate{leaf.tlsCertificate()})
+	assert.Empty(t, st.responses)
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCircuitOpen is returned when requests to a backend are rejected without being sent.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+const (
+	defaultOutlierEjectionTime = time.Second * 30
+	// maxOutlierEjectionMultiplier caps how long repeatedly failing endpoints are ejected for.
+	maxOutlierEjectionMultiplier = 10
+)
+
+// outlierDetection determines when endpoints are ejected from a backend because they are failing.
+type outlierDetection struct {
+	consecutiveErrors int
+	latencyThreshold  time.Duration
+	ejectionTime      time.Duration
+}
+
+func parseOutlierDetection(consecutiveErrors, latencyThreshold, ejectionTime string) (*outlierDetection, error) {
+	od := &outlierDetection{
+		ejectionTime: defaultOutlierEjectionTime,
+	}
+
+	var err error
+	if od.consecutiveErrors, err = strconv.Atoi(consecutiveErrors); err != nil || od.consecutiveErrors <= 0 {
+		return nil, fmt.Errorf("invalid consecutive errors: %s", consecutiveErrors)
+	}
+	if latencyThreshold != "" {
+		if od.latencyThreshold, err = parseDuration(latencyThreshold); err != nil {
+			return nil, fmt.Errorf("invalid latency threshold: %w", err)
+		}
+	}
+	if ejectionTime != "" {
+		if od.ejectionTime, err = parseDuration(ejectionTime); err != nil {
+			return nil, fmt.Errorf("invalid ejection time: %w", err)
+		}
+	}
+	return od, nil
+}
+
+// isFailure returns true if the result of a request counts as an endpoint failure. Errors and 5xx
+// responses are failures, as are responses slower than the latency threshold.
+func (od *outlierDetection) isFailure(statusCode int, err error, latency time.Duration) bool {
+	if err != nil || statusCode >= 500 {
+		return true
+	}
+	return od.latencyThreshold > 0 && latency > od.latencyThreshold
+}
+
+// endpointHealth is the health of a single endpoint of a backend, as determined by outlier detection
+// and active health checks.
+type endpointHealth struct {
+	consecutiveErrors int
+	ejections         int
+	ejectedUntil      time.Time
+
+	unhealthy      bool
+	checkSuccesses int
+	checkFailures  int
+}
+
+func (h *endpointHealth) available(now time.Time) bool {
+	return !h.unhealthy && !now.Before(h.ejectedUntil)
+}
+
+// record records the result of a request and returns true if the endpoint was ejected.
+func (h *endpointHealth) record(od *outlierDetection, failed bool, now time.Time) bool {
+	if !failed {
+		h.consecutiveErrors = 0
+		if h.ejections > 0 && now.Sub(h.ejectedUntil) > od.ejectionTime {
+			// the endpoint has been healthy for a while, so forget previous ejections
+			h.ejections = 0
+		}
+		return false
+	}
+
+	h.consecutiveErrors++
+	if h.consecutiveErrors < od.consecutiveErrors || now.Before(h.ejectedUntil) {
+		return false
+	}
+	if h.ejections < maxOutlierEjectionMultiplier {
+		h.ejections++
+	}
+	h.consecutiveErrors = 0
+	h.ejectedUntil = now.Add(od.ejectionTime * time.Duration(h.ejections))
+	return true
+}
+
+const defaultCircuitBreakerOpenTime = time.Second * 30
+
+// The states of a circuit breaker.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker caps the concurrent requests and connections to a backend. Requests count from
+// the time they're proxied until the response has been written, so requests waiting for a
+// connection count as well as those the backend is handling. With a consecutive failures
+// threshold, it also opens after that many failed requests in a row, rejecting requests until the
+// open time has passed. A single probe request is then let through (half-open), which closes the
+// breaker if it succeeds and opens it again if it fails.
+type circuitBreaker struct {
+	maxRequests         int32
+	maxConnections      int32
+	consecutiveFailures int
+	openTime            time.Duration
+
+	activeRequests int32
+	connections    int32
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probeAt   time.Time
+}
+
+func parseCircuitBreaker(maxRequests, maxConnections, consecutiveFailures, openTime string) (*circuitBreaker, error) {
+	cb := &circuitBreaker{
+		openTime: defaultCircuitBreakerOpenTime,
+		state:    circuitClosed,
+	}
+	for _, limit := range []struct {
+		name  string
+		value string
+		dst   *int32
+	}{
+		{"max requests", maxRequests, &cb.maxRequests},
+		{"max connections", maxConnections, &cb.maxConnections},
+	} {
+		if limit.value == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(limit.value, 10, 32)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", limit.name, limit.value)
+		}
+		*limit.dst = int32(v)
+	}
+	if consecutiveFailures != "" {
+		var err error
+		if cb.consecutiveFailures, err = strconv.Atoi(consecutiveFailures); err != nil || cb.consecutiveFailures <= 0 {
+			return nil, fmt.Errorf("invalid consecutive failures: %s", consecutiveFailures)
+		}
+	}
+	if openTime != "" {
+		if cb.consecutiveFailures == 0 {
+			return nil, errors.New("open time requires consecutive failures")
+		}
+		var err error
+		if cb.openTime, err = parseDuration(openTime); err != nil {
+			return nil, fmt.Errorf("invalid open time: %w", err)
+		}
+	}
+	return cb, nil
+}
+
+// clone returns a closed circuit breaker with the same settings and no requests or connections.
+func (cb *circuitBreaker) clone() *circuitBreaker {
+	if cb == nil {
+		return nil
+	}
+	return &circuitBreaker{
+		maxRequests:         cb.maxRequests,
+		maxConnections:      cb.maxConnections,
+		consecutiveFailures: cb.consecutiveFailures,
+		openTime:            cb.openTime,
+		state:               circuitClosed,
+	}
+}
+
+// allow returns false if the breaker is open. Once the open time has passed, one request is allowed
+// through as a probe. Another probe is allowed if a probe's result isn't recorded within the open time.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb == nil || cb.consecutiveFailures == 0 {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if now.Before(cb.openUntil) {
+			return false
+		}
+		cb.state = circuitHalfOpen
+	case circuitHalfOpen:
+		if now.Sub(cb.probeAt) < cb.openTime {
+			return false
+		}
+	default:
+		return true
+	}
+	cb.probeAt = now
+	return true
+}
+
+// record records the result of a request to the backend.
+func (cb *circuitBreaker) record(failed bool, now time.Time) {
+	if cb == nil || cb.consecutiveFailures == 0 {
+		return
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.consecutiveFailures {
+			cb.state = circuitOpen
+			cb.failures = 0
+			cb.openUntil = now.Add(cb.openTime)
+		}
+	case circuitHalfOpen:
+		if !failed {
+			cb.state = circuitClosed
+			return
+		}
+		cb.state = circuitOpen
+		cb.openUntil = now.Add(cb.openTime)
+	}
+	// results of requests sent before the breaker opened are ignored while it's open
+}
+
+// getState returns the state of the breaker, or "" if it doesn't open on failures.
+func (cb *circuitBreaker) getState() string {
+	if cb == nil || cb.consecutiveFailures == 0 {
+		return ""
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// A breakerTransport records the results of requests to a backend in its circuit breaker. Requests
+// rejected by the breaker itself and requests canceled by the client aren't counted.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	switch {
+	case isCircuitOpen(err), errors.Is(err, context.Canceled):
+	default:
+		t.breaker.record(err != nil || res.StatusCode >= 500, time.Now())
+	}
+	return res, err
+}
+
+// acquireRequest returns false if there are too many concurrent requests. Otherwise releaseRequest
+// must be called once the request completes.
+func (cb *circuitBreaker) acquireRequest() bool {
+	if cb == nil || cb.maxRequests == 0 {
+		return true
+	}
+	if atomic.AddInt32(&cb.activeRequests, 1) > cb.maxRequests {
+		atomic.AddInt32(&cb.activeRequests, -1)
+		return false
+	}
+	return true
+}
+
+func (cb *circuitBreaker) releaseRequest() {
+	if cb == nil || cb.maxRequests == 0 {
+		return
+	}
+	atomic.AddInt32(&cb.activeRequests, -1)
+}
+
+type dialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// limitDial wraps dial so that new connections fail once the connection limit is reached.
+// Requests can still use idle connections.
+func (cb *circuitBreaker) limitDial(dial dialFunc) dialFunc {
+	if cb == nil || cb.maxConnections == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&cb.connections, 1) > cb.maxConnections {
+			atomic.AddInt32(&cb.connections, -1)
+			return nil, fmt.Errorf("%w: too many connections", errCircuitOpen)
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			atomic.AddInt32(&cb.connections, -1)
+			return nil, err
+		}
+		return &countedConn{Conn: conn, count: &cb.connections}, nil
+	}
+}
+
+// A countedConn decrements a counter when closed.
+type countedConn struct {
+	net.Conn
+	count *int32
+	once  sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt32(c.count, -1)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutlierDetection(t *testing.T) {
+	t.Run("ejection", func(t *testing.T) {
+		od, err := parseOutlierDetection("3", "", "10s")
+		if !assert.NoError(t, err) {
+			return
+		}
+		h := new(endpointHealth)
+		now := time.Unix(1000, 0)
+		assert.False(t, h.record(od, true, now))
+		assert.False(t, h.record(od, false, now), "successes should reset the error count")
+		assert.False(t, h.record(od, true, now))
+		assert.False(t, h.record(od, true, now))
+		assert.True(t, h.record(od, true, now))
+		assert.False(t, h.available(now.Add(time.Second*9)))
+		assert.True(t, h.available(now.Add(time.Second*10)))
+
+		now = now.Add(time.Second * 10)
+		for i := 0; i < 3; i++ {
+			h.record(od, true, now)
+		}
+		assert.False(t, h.available(now.Add(time.Second*19)), "repeated ejections should back off")
+		assert.True(t, h.available(now.Add(time.Second*20)))
+	})
+	t.Run("latency", func(t *testing.T) {
+		od, _ := parseOutlierDetection("1", "100ms", "")
+		assert.True(t, od.isFailure(200, nil, time.Second))
+		assert.False(t, od.isFailure(200, nil, time.Millisecond))
+		assert.True(t, od.isFailure(503, nil, time.Millisecond))
+	})
+
+	var failing int32
+	failingSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failing, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingSrv.Close()
+	healthySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthySrv.Close()
+
+	t.Run("proxy", func(t *testing.T) {
+		od, _ := parseOutlierDetection("2", "", "")
+		bp := newBackendProxy(defaultConfig(), "", &url.URL{Scheme: "http", Host: "example:80"}, &ingressOptions{
+			backendProtocol: BackendProtocolHTTP,
+			outlier:         od,
+		})
+		bp.setEndpoints([]string{hostOf(failingSrv), hostOf(healthySrv)})
+		for i := 0; i < 10; i++ {
+			bp.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(&failing), "the failing endpoint should be ejected")
+
+		bp.setEndpoints([]string{hostOf(failingSrv)})
+		w := httptest.NewRecorder()
+		bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, "requests should fail fast when every endpoint is ejected")
+		assert.Equal(t, int32(2), atomic.LoadInt32(&failing))
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("max requests", func(t *testing.T) {
+		started, done := make(chan struct{}), make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-done
+		}))
+		defer srv.Close()
+
+		cb, _ := parseCircuitBreaker("1", "", "", "")
+		u, _ := url.Parse(srv.URL)
+		bp := newBackendProxy(defaultConfig(), "", u, &ingressOptions{
+			backendProtocol: BackendProtocolHTTP,
+			breaker:         cb,
+		})
+		first := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			first <- w.Code
+		}()
+		<-started
+
+		w := httptest.NewRecorder()
+		bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		close(done)
+		assert.Equal(t, http.StatusOK, <-first)
+		assert.Equal(t, int32(0), bp.breaker.activeRequests)
+	})
+	t.Run("connections", func(t *testing.T) {
+		li, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer li.Close()
+
+		cb, _ := parseCircuitBreaker("", "1", "", "")
+		dial := cb.limitDial((&net.Dialer{}).DialContext)
+		conn, err := dial(context.Background(), "tcp", li.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = dial(context.Background(), "tcp", li.Addr().String())
+		assert.True(t, isCircuitOpen(err))
+
+		conn.Close()
+		conn, err = dial(context.Background(), "tcp", li.Addr().String())
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := parseCircuitBreaker("0", "", "", "")
+		assert.Error(t, err)
+		_, err = parseCircuitBreaker("", "x", "", "")
+		assert.Error(t, err)
+		_, err = parseCircuitBreaker("", "", "0", "")
+		assert.Error(t, err)
+		_, err = parseCircuitBreaker("", "", "", "10s")
+		assert.Error(t, err, "the open time requires consecutive failures")
+	})
+	t.Run("states", func(t *testing.T) {
+		cb, err := parseCircuitBreaker("", "", "2", "10s")
+		if !assert.NoError(t, err) {
+			return
+		}
+		now := time.Unix(1000, 0)
+		cb.record(true, now)
+		cb.record(false, now)
+		cb.record(true, now)
+		assert.Equal(t, circuitClosed, cb.getState(), "successes should reset the failure count")
+		cb.record(true, now)
+		assert.Equal(t, circuitOpen, cb.getState())
+		assert.False(t, cb.allow(now.Add(time.Second*9)))
+		cb.record(false, now)
+		assert.Equal(t, circuitOpen, cb.getState(), "results should be ignored while open")
+
+		now = now.Add(time.Second * 10)
+		assert.True(t, cb.allow(now), "a probe should be allowed after the open time")
+		assert.Equal(t, circuitHalfOpen, cb.getState())
+		assert.False(t, cb.allow(now), "only one probe should be allowed")
+		cb.record(true, now)
+		assert.Equal(t, circuitOpen, cb.getState(), "a failed probe should open the breaker again")
+
+		now = now.Add(time.Second * 10)
+		assert.True(t, cb.allow(now))
+		assert.False(t, cb.allow(now.Add(time.Second*9)))
+		assert.True(t, cb.allow(now.Add(time.Second*10)), "another probe should be allowed if a probe never finishes")
+		cb.record(false, now)
+		assert.Equal(t, circuitClosed, cb.getState(), "a successful probe should close the breaker")
+		assert.True(t, cb.allow(now))
+	})
+	t.Run("failures", func(t *testing.T) {
+		var healthy, requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if atomic.LoadInt32(&healthy) == 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+		defer srv.Close()
+
+		cb, _ := parseCircuitBreaker("", "", "3", "50ms")
+		u, _ := url.Parse(srv.URL)
+		bp := newBackendProxy(defaultConfig(), "", u, &ingressOptions{
+			backendProtocol: BackendProtocolHTTP,
+			breaker:         cb,
+		})
+		serve := func() int {
+			w := httptest.NewRecorder()
+			bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			return w.Code
+		}
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusInternalServerError, serve())
+		}
+		assert.Equal(t, http.StatusServiceUnavailable, serve(), "requests should fail fast once the breaker opens")
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+		atomic.StoreInt32(&healthy, 1)
+		time.Sleep(time.Millisecond * 60)
+		assert.Equal(t, http.StatusOK, serve(), "the probe should reach the backend")
+		assert.Equal(t, http.StatusOK, serve())
+		assert.Equal(t, circuitClosed, bp.breaker.getState())
+	})
+}
+
+func hostOf(srv *httptest.Server) string {
+	u, _ := url.Parse(srv.URL)
+	return u.Host
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The versions of the PROXY protocol.
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeaderTimeout is how long a peer has to send its PROXY protocol header.
+const proxyProtocolHeaderTimeout = time.Second * 10
+
+// A proxyProtocolListener decodes the PROXY protocol headers sent by trusted peers, such as L4 load
+// balancers, so that the client's address is used as the connection's remote address. Connections
+// from other peers are used as is, so with no trusted networks no peer is trusted.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtocolListener(li net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{Listener: li, trusted: trusted}
+}
+
+func (li *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := li.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !containsIP(li.trusted, addr.IP) {
+		return conn, nil
+	}
+	// the header is read lazily so that slow peers don't block accepting other connections
+	return &proxyProtocolConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// A proxyProtocolConn is a connection that starts with an optional PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	local  net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remote, c.local, c.err = readProxyProtocolHeader(c.br)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Warn().Err(c.err).Str("remote_addr", c.Conn.RemoteAddr().String()).Msg("invalid proxy protocol header")
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// peerAddr returns the address of the peer that opened the connection, without waiting for its PROXY
+// protocol header.
+func peerAddr(conn net.Conn) net.Addr {
+	if c, ok := conn.(*proxyProtocolConn); ok {
+		return c.Conn.RemoteAddr()
+	}
+	return conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header. It returns nil addresses if there
+// is no header, or if the header doesn't carry the client's address.
+func readProxyProtocolHeader(br *bufio.Reader) (remote, local net.Addr, err error) {
+	if prefix, _ := br.Peek(len(proxyProtocolV2Signature)); bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(br)
+	}
+	if prefix, _ := br.Peek(6); string(prefix) == "PROXY " {
+		return readProxyProtocolV1Header(br)
+	}
+	return nil, nil, nil
+}
+
+func readProxyProtocolV1Header(br *bufio.Reader) (remote, local net.Addr, err error) {
+	// the longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading proxy protocol v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("proxy protocol v1 header too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid proxy protocol v1 header: %q", line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("invalid proxy protocol v1 header: %q", line)
+	}
+	if fields[1] == "TCP4" {
+		if src, dst = src.To4(), dst.To4(); src == nil || dst == nil {
+			return nil, nil, fmt.Errorf("invalid proxy protocol v1 header: %q", line)
+		}
+	}
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+func readProxyProtocolV2Header(br *bufio.Reader) (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol v2 header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, fmt.Errorf("error reading proxy protocol v2 header: %w", err)
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported proxy protocol version: %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0x0:
+		// LOCAL, sent by the load balancer itself, such as for health checks
+		return nil, nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported proxy protocol command: %d", versionCommand&0xf)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// other families, like UDP or unix sockets, don't have a usable address
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("proxy protocol v2 address too short")
+	}
+	src := net.IP(payload[:ipLen])
+	dst := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+// writeProxyProtocolHeader writes a PROXY protocol header. If either address is unknown, the header
+// doesn't carry any addresses.
+func writeProxyProtocolHeader(w io.Writer, version string, src, dst *net.TCPAddr) error {
+	var buf bytes.Buffer
+	known := src != nil && dst != nil && (src.IP.To4() == nil) == (dst.IP.To4() == nil)
+	switch version {
+	case ProxyProtocolV1:
+		switch {
+		case !known:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		case src.IP.To4() != nil:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		default:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port)
+		}
+	case ProxyProtocolV2:
+		buf.Write(proxyProtocolV2Signature)
+		switch {
+		case !known:
+			buf.Write([]byte{0x20, 0x00, 0, 0})
+		case src.IP.To4() != nil:
+			buf.Write([]byte{0x21, 0x11, 0, 12})
+			buf.Write(src.IP.To4())
+			buf.Write(dst.IP.To4())
+		default:
+			buf.Write([]byte{0x21, 0x21, 0, 36})
+			buf.Write(src.IP.To16())
+			buf.Write(dst.IP.To16())
+		}
+		if known {
+			_ = binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+			_ = binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+		}
+	default:
+		return fmt.Errorf("unknown proxy protocol version: %s", version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type proxyProtocolAddrsContextKey struct{}
+
+// proxyProtocolAddrs are the addresses of a client connection sent to backends using the PROXY
+// protocol.
+type proxyProtocolAddrs struct {
+	src, dst *net.TCPAddr
+}
+
+// proxyProtocolDial wraps dial so that every new connection starts with a PROXY protocol header
+// describing the client connection found in the context.
+func proxyProtocolDial(dial dialFunc, version string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, _ := ctx.Value(proxyProtocolAddrsContextKey{}).(proxyProtocolAddrs)
+		if err := writeProxyProtocolHeader(conn, version, addrs.src, addrs.dst); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// withProxyProtocolAddrs returns a context carrying the addresses of the request's client connection.
+func withProxyProtocolAddrs(r *http.Request) context.Context {
+	var addrs proxyProtocolAddrs
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		addrs.src = addr
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		addrs.dst = addr
+	}
+	return context.WithValue(r.Context(), proxyProtocolAddrsContextKey{}, addrs)
+}
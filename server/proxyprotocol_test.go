@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		version  string
+		src, dst *net.TCPAddr
+	}{
+		{ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+		{ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+		{ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+		{ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, writeProxyProtocolHeader(&buf, tc.version, tc.src, tc.dst))
+		buf.WriteString("GET / HTTP/1.1\r\n")
+		br := bufio.NewReader(&buf)
+		remote, local, err := readProxyProtocolHeader(br)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.src, remote, tc.version)
+		assert.Equal(t, tc.dst, local, tc.version)
+		rest, _ := br.ReadString('\n')
+		assert.Equal(t, "GET / HTTP/1.1\r\n", rest, "the connection should continue after the header")
+	}
+
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		var buf bytes.Buffer
+		assert.NoError(t, writeProxyProtocolHeader(&buf, version, nil, nil))
+		remote, _, err := readProxyProtocolHeader(bufio.NewReader(&buf))
+		assert.NoError(t, err)
+		assert.Nil(t, remote, "unknown addresses should be ignored")
+	}
+
+	_, _, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 1.2.3.4\r\n")))
+	assert.Error(t, err)
+	remote, _, err := readProxyProtocolHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n")))
+	assert.NoError(t, err)
+	assert.Nil(t, remote, "connections without a header should be used as is")
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	start := func(trusted string) string {
+		li, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		networks, _ := ParseTrustedProxies(trusted)
+		srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, r.RemoteAddr)
+		})}
+		go func() { _ = srv.Serve(newProxyProtocolListener(li, networks)) }()
+		t.Cleanup(func() { _ = srv.Close() })
+		return li.Addr().String()
+	}
+	get := func(addr string) string {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer conn.Close()
+		_, _ = fmt.Fprint(conn, "PROXY TCP4 1.2.3.4 10.0.0.1 5678 80\r\nGET / HTTP/1.1\r\nHost: example\r\nConnection: close\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer res.Body.Close()
+		bs, _ := io.ReadAll(res.Body)
+		return string(bs)
+	}
+
+	assert.Equal(t, "1.2.3.4:5678", get(start("127.0.0.0/8")))
+	assert.NotEqual(t, "1.2.3.4:5678", get(start("")), "no peer should be trusted by default")
+	assert.NotEqual(t, "1.2.3.4:5678", get(start("10.0.0.0/8")), "headers from untrusted peers should not be decoded")
+
+	_, err := New(WithProxyProtocol(true)).listen("test", "127.0.0.1:0")
+	assert.Error(t, err, "proxy protocol should require trusted networks")
+}
+
+func TestPeerAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &proxyProtocolConn{Conn: server, br: bufio.NewReader(server)}
+	assert.Equal(t, server.RemoteAddr(), peerAddr(conn), "the header should not be read")
+}
+
+func TestProxyProtocolBackend(t *testing.T) {
+	li, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, r.RemoteAddr)
+	}))
+	trusted, _ := ParseTrustedProxies("127.0.0.0/8")
+	backend.Listener = newProxyProtocolListener(li, trusted)
+	backend.Start()
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	bp := newBackendProxy(defaultConfig(), "", u, &ingressOptions{
+		backendProtocol: BackendProtocolHTTP,
+		proxyProtocol:   ProxyProtocolV2,
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.4:5678"
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}))
+	w := httptest.NewRecorder()
+	bp.ServeHTTP(w, r)
+	assert.Equal(t, "1.2.3.4:5678", w.Body.String())
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ways requests are grouped for rate limiting.
+const (
+	rateLimitKeyIP     = "ip"
+	rateLimitKeyHeader = "header"
+	rateLimitKeyJWT    = "jwt"
+)
+
+// rateLimitBucketTTL is how long an idle, full token bucket is kept.
+const rateLimitBucketTTL = time.Minute * 10
+
+// rateLimitOptions configure the token-bucket rate limit of an ingress.
+type rateLimitOptions struct {
+	// rate is the number of tokens added per second.
+	rate  float64
+	burst int
+	// key is how requests are grouped: by client IP, by a header value or by a JWT claim.
+	key     string
+	keyName string
+	perPath bool
+
+	allowlist []*net.IPNet
+}
+
+// parseRateLimit parses a rate limit. The limit is a number of requests per second, minute or hour,
+// like "10/s" or "600/m". The key is "ip", "header:<name>" or "jwt:<claim>".
+func parseRateLimit(limit, burst, key, scope, allowlist string) (*rateLimitOptions, error) {
+	opts := &rateLimitOptions{
+		key: rateLimitKeyIP,
+	}
+
+	count, unit := limit, "s"
+	if idx := strings.IndexByte(limit, '/'); idx >= 0 {
+		count, unit = limit[:idx], limit[idx+1:]
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid limit: %s", limit)
+	}
+	switch unit {
+	case "s":
+		opts.rate = n
+	case "m":
+		opts.rate = n / 60
+	case "h":
+		opts.rate = n / 3600
+	default:
+		return nil, fmt.Errorf("invalid limit unit, expected s, m or h: %s", limit)
+	}
+
+	opts.burst = int(math.Ceil(n))
+	if burst != "" {
+		if opts.burst, err = strconv.Atoi(burst); err != nil || opts.burst <= 0 {
+			return nil, fmt.Errorf("invalid burst: %s", burst)
+		}
+	}
+
+	if key != "" {
+		opts.key = strings.ToLower(key)
+		if idx := strings.IndexByte(key, ':'); idx >= 0 {
+			opts.key, opts.keyName = strings.ToLower(key[:idx]), key[idx+1:]
+		}
+		switch {
+		case opts.key == rateLimitKeyIP && opts.keyName == "":
+		case (opts.key == rateLimitKeyHeader || opts.key == rateLimitKeyJWT) && opts.keyName != "":
+		default:
+			return nil, fmt.Errorf("invalid key, expected ip, header:<name> or jwt:<claim>: %s", key)
+		}
+	}
+
+	switch scope {
+	case "", "ingress":
+	case "path":
+		opts.perPath = true
+	default:
+		return nil, fmt.Errorf("invalid scope, expected ingress or path: %s", scope)
+	}
+
+	for _, v := range splitList(allowlist) {
+		network, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.allowlist = append(opts.allowlist, network)
+	}
+	return opts, nil
+}
+
+// parseCIDR parses a CIDR or a single IP address.
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", s)
+	}
+	return network, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A RateLimit is a token bucket's refill rate and capacity.
+type RateLimit struct {
+	// Rate is the number of tokens added per second.
+	Rate  float64
+	Burst int
+}
+
+// duration returns how long it takes to add the given number of tokens.
+func (limit RateLimit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / limit.Rate * float64(time.Second))
+}
+
+// A RateLimitResult is the outcome of taking a token from a bucket.
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full.
+	Reset time.Duration
+}
+
+// A RateLimitStore stores the token buckets used for rate limiting. By default every rate-limited
+// ingress has its own in-process store, so limits apply per replica. A store shared by every replica
+// makes the limits cluster-wide.
+type RateLimitStore interface {
+	// Take takes a token from the bucket with the given key.
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// A MemoryRateLimitStore is a RateLimitStore that keeps token buckets in memory.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryRateLimitStore creates a new MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Take takes a token from the bucket with the given key.
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	var res RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = limit.duration(1 - b.tokens)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = limit.duration(float64(limit.Burst) - b.tokens)
+	return res, nil
+}
+
+// sweep removes buckets that have been idle long enough to be full again.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitBucketTTL {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		idle := now.Sub(b.last)
+		if idle > rateLimitBucketTTL && idle > b.limit.duration(float64(b.limit.Burst)) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// A rateLimiter enforces an ingress's rate limit using a token bucket per client. Bucket keys are
+// prefixed so that ingresses can share a store.
+type rateLimiter struct {
+	opts   *rateLimitOptions
+	store  RateLimitStore
+	prefix string
+}
+
+func newRateLimiter(opts *rateLimitOptions, store RateLimitStore, prefix string) *rateLimiter {
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	return &rateLimiter{
+		opts:   opts,
+		store:  store,
+		prefix: prefix,
+	}
+}
+
+func (l *rateLimiter) limit() RateLimit {
+	return RateLimit{Rate: l.opts.rate, Burst: l.opts.burst}
+}
+
+// handle applies the rate limit to the request. The route identifies the matched host and path for
+// per-path limits. It returns false if the request was rejected, in which case a 429 response has
+// been written.
+func (l *rateLimiter) handle(w http.ResponseWriter, r *http.Request, route string) bool {
+	ip := clientIP(r)
+	if ip != nil && containsIP(l.opts.allowlist, ip) {
+		return true
+	}
+
+	key := l.key(r, ip)
+	if l.opts.perPath {
+		key = route + " " + key
+	}
+	res, err := l.store.Take(r.Context(), l.prefix+" "+key, l.limit(), time.Now())
+	if err != nil {
+		// fail open so that an unavailable store doesn't take down every rate-limited ingress
+		requestLogger(r).Error().Err(err).Str("host", r.Host).Str("path", r.URL.Path).Msg("failed to apply rate limit")
+		return true
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(l.opts.burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if res.Allowed {
+		return true
+	}
+
+	requestLogger(r).Info().Str("host", r.Host).Str("path", r.URL.Path).Str("key", key).Msg("rate limit exceeded")
+	h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return false
+}
+
+// key returns the bucket key for the request. Requests without the configured header or claim are
+// grouped by client IP.
+func (l *rateLimiter) key(r *http.Request, ip net.IP) string {
+	switch l.opts.key {
+	case rateLimitKeyHeader:
+		if v := r.Header.Get(l.opts.keyName); v != "" {
+			return "header:" + v
+		}
+	case rateLimitKeyJWT:
+		if v := jwtClaim(r, l.opts.keyName); v != "" {
+			return "jwt:" + v
+		}
+	}
+	return "ip:" + ip.String()
+}
+
+// jwtClaim returns a claim from the request's bearer token. The token's signature is not verified, so
+// the claim is only suitable for grouping requests.
+func jwtClaim(r *http.Request, claim string) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	parts := strings.Split(auth[7:], ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
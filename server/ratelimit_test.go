@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Run("token bucket", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		limit := RateLimit{Rate: 1, Burst: 2}
+		take := func(key string, now time.Time) RateLimitResult {
+			res, err := store.Take(context.Background(), key, limit, now)
+			assert.NoError(t, err)
+			return res
+		}
+		now := time.Unix(1000, 0)
+		assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 1, Reset: time.Second}, take("a", now))
+		assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 0, Reset: time.Second * 2}, take("a", now))
+		assert.Equal(t, RateLimitResult{RetryAfter: time.Second, Reset: time.Second * 2}, take("a", now))
+		assert.True(t, take("b", now).Allowed, "keys should have separate buckets")
+		assert.True(t, take("a", now.Add(time.Second)).Allowed, "tokens should be refilled")
+
+		take("c", now)
+		take("c", now.Add(rateLimitBucketTTL*2))
+		assert.Len(t, store.buckets, 1, "idle buckets should be removed")
+	})
+	t.Run("keys", func(t *testing.T) {
+		newRequest := func(remoteAddr string) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = remoteAddr
+			return r
+		}
+		opts, _ := parseRateLimit("1", "", "header:X-API-Key", "", "")
+		l := newRateLimiter(opts, nil, "")
+		r := newRequest("10.0.0.1:1234")
+		assert.Equal(t, "ip:10.0.0.1", l.key(r, clientIP(r)))
+		r.Header.Set("X-API-Key", "secret")
+		assert.Equal(t, "header:secret", l.key(r, clientIP(r)))
+
+		opts, _ = parseRateLimit("1", "", "jwt:sub", "", "")
+		l = newRateLimiter(opts, nil, "")
+		r = newRequest("[::1]:1234")
+		assert.Equal(t, "ip:::1", l.key(r, clientIP(r)))
+		r.Header.Set("Authorization", "Bearer e30."+base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`))+".sig")
+		assert.Equal(t, "jwt:user-1", l.key(r, clientIP(r)))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, args := range [][5]string{
+			{"0", "", "", "", ""},
+			{"10/d", "", "", "", ""},
+			{"10", "-1", "", "", ""},
+			{"10", "", "header", "", ""},
+			{"10", "", "cookie:session", "", ""},
+			{"10", "", "", "host", ""},
+			{"10", "", "", "", "10.0.0.0/33"},
+		} {
+			_, err := parseRateLimit(args[0], args[1], args[2], args[3], args[4])
+			assert.Error(t, err, args)
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+
+		s := New()
+		s.Update(newTestPayload(map[string]string{
+			RateLimitAnnotation:          "1/h",
+			RateLimitScopeAnnotation:     "path",
+			RateLimitAllowlistAnnotation: "192.168.0.0/16",
+		}, hostOf(backend)))
+
+		get := func(path, remoteAddr string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "http://www.example.com"+path, nil)
+			r.RemoteAddr = remoteAddr
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w
+		}
+
+		w := get("/a", "10.0.0.1:1234")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+		w = get("/a", "10.0.0.1:1234")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+
+		assert.Equal(t, http.StatusOK, get("/b", "10.0.0.1:1234").Code, "paths should be limited separately")
+		assert.Equal(t, http.StatusOK, get("/a", "10.0.0.2:1234").Code, "clients should be limited separately")
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, get("/a", "192.168.1.1:1234").Code, "allowlisted clients should not be limited")
+		}
+
+		s.Update(newTestPayload(map[string]string{
+			RateLimitAnnotation:          "1/h",
+			RateLimitScopeAnnotation:     "path",
+			RateLimitAllowlistAnnotation: "192.168.0.0/16",
+		}, hostOf(backend)))
+		assert.Equal(t, http.StatusTooManyRequests, get("/a", "10.0.0.1:1234").Code, "limits should survive routing table updates")
+	})
+	t.Run("shared store", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+
+		get := func(s *Server) int {
+			r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w.Code
+		}
+		newServer := func(store RateLimitStore) *Server {
+			s := New(WithRateLimitStore(store))
+			s.Update(newTestPayload(map[string]string{RateLimitAnnotation: "1/h"}, hostOf(backend)))
+			return s
+		}
+
+		store := NewMemoryRateLimitStore()
+		s1, s2 := newServer(store), newServer(store)
+		assert.Equal(t, http.StatusOK, get(s1))
+		assert.Equal(t, http.StatusTooManyRequests, get(s2), "replicas should share the limit")
+
+		s3 := newServer(failingRateLimitStore{})
+		assert.Equal(t, http.StatusOK, get(s3))
+		assert.Equal(t, http.StatusOK, get(s3), "requests should be allowed when the store fails")
+	})
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(context.Context, string, RateLimit, time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("unavailable")
+}
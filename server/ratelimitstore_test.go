@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisRateLimitStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	newStore := func() *RedisRateLimitStore {
+		store, err := NewRedisRateLimitStoreFromURL("redis://" + mr.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+
+	t.Run("token bucket", func(t *testing.T) {
+		store := newStore()
+		limit := RateLimit{Rate: 1, Burst: 2}
+		take := func(key string, now time.Time) RateLimitResult {
+			res, err := store.Take(context.Background(), key, limit, now)
+			assert.NoError(t, err)
+			return res
+		}
+		now := time.Unix(1000, 0)
+		assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 1, Reset: time.Second}, take("a", now))
+		assert.Equal(t, RateLimitResult{Allowed: true, Remaining: 0, Reset: time.Second * 2}, take("a", now))
+		assert.Equal(t, RateLimitResult{RetryAfter: time.Second, Reset: time.Second * 2}, take("a", now))
+		assert.True(t, take("b", now).Allowed, "keys should have separate buckets")
+		assert.True(t, take("a", now.Add(time.Second)).Allowed, "tokens should be refilled")
+		assert.False(t, take("a", now.Add(time.Millisecond*500)).Allowed, "time should not move backwards")
+		assert.Greater(t, mr.TTL(redisRateLimitKeyPrefix+"a"), time.Duration(0), "buckets should expire")
+	})
+	t.Run("replicas", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer backend.Close()
+
+		newServer := func() *Server {
+			s := New(WithRateLimitStore(newStore()))
+			s.Update(newTestPayload(map[string]string{RateLimitAnnotation: "2/h"}, hostOf(backend)))
+			return s
+		}
+		get := func(s *Server) int {
+			r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		s1, s2 := newServer(), newServer()
+		assert.Equal(t, http.StatusOK, get(s1))
+		assert.Equal(t, http.StatusOK, get(s2))
+		assert.Equal(t, http.StatusTooManyRequests, get(s1), "replicas should draw from one budget")
+		assert.Equal(t, http.StatusTooManyRequests, get(s2), "replicas should draw from one budget")
+
+		mr.SetError("unavailable")
+		defer mr.SetError("")
+		assert.Equal(t, http.StatusOK, get(s1), "requests should be allowed when redis fails")
+	})
+}
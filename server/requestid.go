@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxRequestIDLength is the longest incoming request ID that is reused.
+const maxRequestIDLength = 200
+
+// setRequestID assigns the request an ID, reusing a valid incoming ID from the header. The ID is sent
+// to the backend, returned to the client and added to every log line about the request.
+func setRequestID(w http.ResponseWriter, r *http.Request, header string) *http.Request {
+	id := r.Header.Get(header)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(header, id)
+	}
+	w.Header().Set(header, id)
+
+	logger := log.With().Str("request_id", id).Logger()
+	return r.WithContext(logger.WithContext(r.Context()))
+}
+
+// isValidRequestID returns true if the ID is short and only contains characters that are safe to
+// log and pass along.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '+', c == '/', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// requestLogger returns the logger for a request, which includes the request ID.
+func requestLogger(r *http.Request) *zerolog.Logger {
+	if logger := zerolog.Ctx(r.Context()); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	log.Logger = zerolog.New(&logs)
+
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("X-Trace-Id")
+	}))
+	defer backend.Close()
+
+	s := New(WithRequestIDHeader("x-trace-id"))
+	s.Update(newTestPayload(nil, hostOf(backend)))
+	get := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+		if id != "" {
+			r.Header.Set("X-Trace-Id", id)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("abc-123")
+	assert.Equal(t, "abc-123", received, "valid ids should be reused")
+	assert.Equal(t, "abc-123", w.Header().Get("X-Trace-Id"))
+	assert.Contains(t, logs.String(), `"request_id":"abc-123"`)
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, id := range []string{"", "has spaces", string(bytes.Repeat([]byte("a"), maxRequestIDLength+1))} {
+		w = get(id)
+		assert.Regexp(t, uuid, received, "invalid ids should be replaced")
+		assert.Equal(t, received, w.Header().Get("X-Trace-Id"))
+	}
+	assert.NotEqual(t, newRequestID(), newRequestID())
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRetryBodySize is the largest request body buffered so that it can be replayed.
+	maxRetryBodySize = 1 << 20
+	// retryBudgetWindow is the period over which requests and retries are counted for the budget.
+	retryBudgetWindow = 10
+	// minRetriesPerSecond is the number of retries always allowed regardless of the budget.
+	minRetriesPerSecond = 1
+)
+
+// A retryPolicy determines when failed requests to a backend are retried.
+type retryPolicy struct {
+	attempts      int
+	statuses      map[int]bool
+	nonIdempotent bool
+	budgetPercent float64
+}
+
+func parseRetryPolicy(attempts, statuses, nonIdempotent, budgetPercent string) (*retryPolicy, error) {
+	policy := &retryPolicy{
+		statuses:      make(map[int]bool),
+		budgetPercent: 20,
+	}
+
+	var err error
+	if policy.attempts, err = strconv.Atoi(attempts); err != nil || policy.attempts < 0 {
+		return nil, fmt.Errorf("invalid retry attempts: %s", attempts)
+	}
+	for _, v := range splitList(statuses) {
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 500 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status code, expected 5xx: %s", v)
+		}
+		policy.statuses[code] = true
+	}
+	if nonIdempotent != "" {
+		if policy.nonIdempotent, err = strconv.ParseBool(nonIdempotent); err != nil {
+			return nil, fmt.Errorf("invalid retry non-idempotent value: %s", nonIdempotent)
+		}
+	}
+	if budgetPercent != "" {
+		if policy.budgetPercent, err = strconv.ParseFloat(budgetPercent, 64); err != nil ||
+			policy.budgetPercent < 0 || policy.budgetPercent > 100 {
+			return nil, fmt.Errorf("invalid retry budget percent: %s", budgetPercent)
+		}
+	}
+	return policy, nil
+}
+
+// canRetry returns true if the request may be retried at all. Only idempotent requests are retried
+// unless the policy allows non-idempotent requests with replayable bodies.
+func (p *retryPolicy) canRetry(req *http.Request) bool {
+	return p != nil && p.attempts > 0 && (isIdempotent(req) || p.nonIdempotent)
+}
+
+func (p *retryPolicy) shouldRetryStatus(code int) bool {
+	return p.statuses[code]
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	// the same headers as http.Transport
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// bufferBody buffers the request body so that it can be replayed. It returns false if the body is
+// too large, in which case the request can't be retried but can still be sent once.
+func bufferBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > maxRetryBodySize {
+		return false, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBodySize+1))
+	if err != nil {
+		return false, err
+	}
+	if len(buf) > maxRetryBodySize {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), req.Body))
+		return false, nil
+	}
+	_ = req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// A retryBudget limits retries to a percentage of the requests made to a backend, so that retries
+// don't multiply the load on a backend during an outage.
+type retryBudget struct {
+	percent float64
+
+	mu      sync.Mutex
+	buckets [retryBudgetWindow]retryBudgetBucket
+}
+
+type retryBudgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func newRetryBudget(percent float64) *retryBudget {
+	return &retryBudget{percent: percent}
+}
+
+func (b *retryBudget) bucket(now time.Time) *retryBudgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%retryBudgetWindow]
+	if bucket.second != second {
+		*bucket = retryBudgetBucket{second: second}
+	}
+	return bucket
+}
+
+// recordRequest records a request to the backend.
+func (b *retryBudget) recordRequest(now time.Time) {
+	b.mu.Lock()
+	b.bucket(now).requests++
+	b.mu.Unlock()
+}
+
+// allowRetry returns true and records a retry if the budget allows it.
+func (b *retryBudget) allowRetry(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var requests, retries int
+	for _, bucket := range b.buckets {
+		if now.Unix()-bucket.second < retryBudgetWindow {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := float64(requests) * b.percent / 100
+	if min := float64(minRetriesPerSecond * retryBudgetWindow); allowed < min {
+		allowed = min
+	}
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetries(t *testing.T) {
+	var failing, healthy int32
+	failingSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failing, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingSrv.Close()
+	healthySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthy, 1)
+		bs, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(bs)
+	}))
+	defer healthySrv.Close()
+
+	// a closed listener refuses connections
+	li, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := li.Addr().String()
+	li.Close()
+
+	newProxy := func(retry string, endpoints ...string) *backendProxy {
+		policy, err := parseRetryPolicy(retry, "503", "", "")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		bp := newBackendProxy(defaultConfig(), "", &url.URL{Scheme: "http", Host: "example:80"}, &ingressOptions{
+			backendProtocol: BackendProtocolHTTP,
+			retry:           policy,
+		})
+		bp.setEndpoints(endpoints)
+		return bp
+	}
+
+	t.Run("retries on status", func(t *testing.T) {
+		bp := newProxy("1", hostOf(failingSrv), hostOf(healthySrv))
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			bp.ServeHTTP(w, httptest.NewRequest("PUT", "/", strings.NewReader("hello")))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "hello", w.Body.String(), "the body should be replayed")
+		}
+	})
+	t.Run("retries on connection errors", func(t *testing.T) {
+		bp := newProxy("1", closedAddr, hostOf(healthySrv))
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	})
+	t.Run("non-idempotent requests", func(t *testing.T) {
+		bp := newProxy("1", hostOf(failingSrv))
+		before := atomic.LoadInt32(&failing)
+		w := httptest.NewRecorder()
+		bp.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("hello")))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&failing)-before, "POST requests should not be retried")
+
+		r := httptest.NewRequest("POST", "/", strings.NewReader("hello"))
+		r.Header.Set("Idempotency-Key", "1")
+		bp.ServeHTTP(httptest.NewRecorder(), r)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&failing)-before, "requests with an idempotency key should be retried")
+	})
+	t.Run("budget", func(t *testing.T) {
+		budget := newRetryBudget(20)
+		now := time.Unix(1000, 0)
+		allowed := 0
+		for i := 0; i < 100; i++ {
+			budget.recordRequest(now)
+			if budget.allowRetry(now) {
+				allowed++
+			}
+		}
+		assert.Equal(t, 20, allowed)
+		assert.True(t, budget.allowRetry(now.Add(retryBudgetWindow*time.Second)), "old retries should expire")
+	})
+	t.Run("invalid policy", func(t *testing.T) {
+		_, err := parseRetryPolicy("-1", "", "", "")
+		assert.Error(t, err)
+		_, err = parseRetryPolicy("1", "404", "", "")
+		assert.Error(t, err)
+		_, err = parseRetryPolicy("1", "", "", "150")
+		assert.Error(t, err)
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -14,23 +15,37 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-const BackendProtocolAnnotation = "kubernetes-simple-ingress-controller/backend-protocol"
-
 // A RoutingTable contains the information needed to route a request.
 type RoutingTable struct {
+	cfg                *config
 	certificatesByHost map[string]map[string]*tls.Certificate
 	backendsByHost     map[string][]routingTableBackend
+	clientAuthByHost   map[string]*clientAuth
+	tlsPolicyByHost    map[string]TLSPolicy
+	proxies            map[string]*backendProxy
+	rateLimiters       map[string]*rateLimiter
+	concurrencyLimits  map[string]*concurrencyLimiter
+	caches             map[string]*responseCache
+
+	certificateStatuses []watcher.CertificateStatus
 }
 
 type routingTableBackend struct {
-	pathRE *regexp.Regexp
-	url    *url.URL
+	host        string
+	pathRE      *regexp.Regexp
+	url         *url.URL
+	opts        *ingressOptions
+	proxy       *backendProxy
+	rateLimiter *rateLimiter
+	concurrency *concurrencyLimiter
+	cache       *responseCache
 }
 
-func newRoutingTableBackend(scheme string, path string, serviceName string, servicePort int) (routingTableBackend, error) {
+func newRoutingTableBackend(opts *ingressOptions, path string, serviceName string, servicePort int) (routingTableBackend, error) {
 	rtb := routingTableBackend{
+		opts: opts,
 		url: &url.URL{
-			Scheme: scheme,
+			Scheme: backendScheme(opts.backendProtocol),
 			Host:   fmt.Sprintf("%s:%d", serviceName, servicePort),
 		},
 	}
@@ -48,21 +63,54 @@ func (rtb routingTableBackend) matches(path string) bool {
 	return rtb.pathRE.MatchString(path)
 }
 
+// path returns the path pattern of the backend, or an empty string if it matches every path.
+func (rtb routingTableBackend) path() string {
+	if rtb.pathRE == nil {
+		return ""
+	}
+	return rtb.pathRE.String()
+}
+
 // NewRoutingTable creates a new RoutingTable.
 func NewRoutingTable(payload *watcher.Payload) *RoutingTable {
+	return newRoutingTable(defaultConfig(), payload, nil)
+}
+
+// newRoutingTable creates a new RoutingTable. Backend proxies are reused from the previous routing
+// table when their configuration hasn't changed.
+func newRoutingTable(cfg *config, payload *watcher.Payload, prev *RoutingTable) *RoutingTable {
 	rt := &RoutingTable{
+		cfg:                cfg,
 		certificatesByHost: make(map[string]map[string]*tls.Certificate),
 		backendsByHost:     make(map[string][]routingTableBackend),
+		clientAuthByHost:   make(map[string]*clientAuth),
+		tlsPolicyByHost:    make(map[string]TLSPolicy),
+		proxies:            make(map[string]*backendProxy),
+		rateLimiters:       make(map[string]*rateLimiter),
+		concurrencyLimits:  make(map[string]*concurrencyLimiter),
+		caches:             make(map[string]*responseCache),
 	}
-	rt.init(payload)
+	rt.init(cfg, payload, prev)
 	return rt
 }
 
-func (rt *RoutingTable) init(payload *watcher.Payload) {
+func (rt *RoutingTable) init(cfg *config, payload *watcher.Payload, prev *RoutingTable) {
 	if payload == nil {
 		return
 	}
+	rt.certificateStatuses = payload.Certificates
 	for _, ingressPayload := range payload.Ingresses {
+		opts, err := parseIngressOptions(ingressPayload)
+		if err == nil && opts.tlsPolicy != nil {
+			err = validateHostTLSPolicy(cfg.tlsPolicy, *opts.tlsPolicy)
+		}
+		if err != nil {
+			log.Error().Err(err).
+				Str("namespace", ingressPayload.Ingress.Namespace).
+				Str("name", ingressPayload.Ingress.Name).
+				Msg("invalid ingress annotations, ignoring ingress")
+			continue
+		}
 		for _, rule := range ingressPayload.Ingress.Spec.Rules {
 			m, ok := rt.certificatesByHost[rule.Host]
 			if !ok {
@@ -77,44 +125,190 @@ func (rt *RoutingTable) init(payload *watcher.Payload) {
 					}
 				}
 			}
-			rt.addBackend(ingressPayload, rule)
+			if opts.clientAuth != nil {
+				if _, ok := rt.clientAuthByHost[rule.Host]; ok {
+					log.Warn().Str("host", rule.Host).Msg("client certificate authentication configured by multiple ingresses")
+				} else {
+					rt.clientAuthByHost[rule.Host] = opts.clientAuth
+				}
+			}
+			if opts.tlsPolicy != nil {
+				if _, ok := rt.tlsPolicyByHost[rule.Host]; ok {
+					log.Warn().Str("host", rule.Host).Msg("tls policy configured by multiple ingresses")
+				} else {
+					rt.tlsPolicyByHost[rule.Host] = cfg.tlsPolicy.merge(*opts.tlsPolicy)
+				}
+			}
+			rt.addBackend(ingressPayload, opts, rule, prev)
 		}
 	}
 }
 
-func (rt *RoutingTable) addBackend(ingressPayload watcher.IngressPayload, rule networking.IngressRule) {
-	scheme, ok := ingressPayload.Ingress.Annotations[BackendProtocolAnnotation]
-	if !ok {
-		scheme = "http"
-	}
-	scheme = strings.ToLower(scheme)
-
+func (rt *RoutingTable) addBackend(ingressPayload watcher.IngressPayload, opts *ingressOptions, rule networking.IngressRule, prev *RoutingTable) {
 	if rule.HTTP == nil {
 		if ingressPayload.Ingress.Spec.DefaultBackend != nil {
 			backend := ingressPayload.Ingress.Spec.DefaultBackend
-			rtb, err := newRoutingTableBackend(scheme, "", backend.Service.Name,
-				rt.getServicePort(ingressPayload, backend.Service.Name, intstr.FromInt(int(backend.Service.Port.Number))))
+			port := rt.getServicePort(ingressPayload, backend.Service.Name, intstr.FromInt(int(backend.Service.Port.Number)))
+			rtb, err := newRoutingTableBackend(opts, "", backend.Service.Name, port)
 			if err != nil {
 				// this shouldn't happen
 				log.Error().Err(err).Send()
 				return
 			}
+			rtb.proxy = rt.getProxy(ingressPayload, opts, rtb.url, prev)
+			rtb.proxy.setEndpoints(rt.getServiceEndpoints(ingressPayload, backend.Service.Name, port))
+			rtb.host = rule.Host
+			rtb.rateLimiter = rt.getRateLimiter(ingressPayload, opts, prev)
+			rtb.concurrency = rt.getConcurrencyLimiter(ingressPayload, opts, prev)
+			rtb.cache = rt.getCache(ingressPayload, opts, prev)
 			rt.backendsByHost[rule.Host] = append(rt.backendsByHost[rule.Host], rtb)
 		}
 	} else {
 		for _, path := range rule.HTTP.Paths {
 			backend := path.Backend
-			rtb, err := newRoutingTableBackend(scheme, path.Path, backend.Service.Name,
-				rt.getServicePort(ingressPayload, backend.Service.Name, intstr.FromInt(int(backend.Service.Port.Number))))
+			port := rt.getServicePort(ingressPayload, backend.Service.Name, intstr.FromInt(int(backend.Service.Port.Number)))
+			rtb, err := newRoutingTableBackend(opts, path.Path, backend.Service.Name, port)
 			if err != nil {
 				log.Error().Err(err).Interface("path", path).Msg("invalid ingress rule path regex")
 				continue
 			}
+			rtb.proxy = rt.getProxy(ingressPayload, opts, rtb.url, prev)
+			rtb.proxy.setEndpoints(rt.getServiceEndpoints(ingressPayload, backend.Service.Name, port))
+			rtb.host = rule.Host
+			rtb.rateLimiter = rt.getRateLimiter(ingressPayload, opts, prev)
+			rtb.concurrency = rt.getConcurrencyLimiter(ingressPayload, opts, prev)
+			rtb.cache = rt.getCache(ingressPayload, opts, prev)
 			rt.backendsByHost[rule.Host] = append(rt.backendsByHost[rule.Host], rtb)
 		}
 	}
 }
 
+// getProxy returns the proxy for a backend, reusing an existing one if possible.
+func (rt *RoutingTable) getProxy(ingressPayload watcher.IngressPayload, opts *ingressOptions, u *url.URL, prev *RoutingTable) *backendProxy {
+	key := fmt.Sprintf("%s/%s %s %s", ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name, u, opts.fingerprint)
+	if bp, ok := rt.proxies[key]; ok {
+		return bp
+	}
+	bp, ok := prev.getProxyByKey(key)
+	if !ok {
+		bp = newBackendProxy(rt.cfg, key, u, opts)
+		bp.namespace, bp.ingress = ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name
+	}
+	rt.proxies[key] = bp
+	return bp
+}
+
+func (rt *RoutingTable) getProxyByKey(key string) (*backendProxy, bool) {
+	if rt == nil {
+		return nil, false
+	}
+	bp, ok := rt.proxies[key]
+	return bp, ok
+}
+
+// getRateLimiter returns the rate limiter for an ingress, reusing an existing one if possible so that
+// clients aren't given fresh buckets whenever the routing table changes. It returns nil if the
+// ingress isn't rate limited. Rate limiters use the configured shared store, if any.
+func (rt *RoutingTable) getRateLimiter(ingressPayload watcher.IngressPayload, opts *ingressOptions, prev *RoutingTable) *rateLimiter {
+	if opts.rateLimit == nil {
+		return nil
+	}
+	name := fmt.Sprintf("%s/%s", ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name)
+	key := fmt.Sprintf("%s %s", name, opts.fingerprint)
+	if l, ok := rt.rateLimiters[key]; ok {
+		return l
+	}
+	var l *rateLimiter
+	if prev != nil {
+		l = prev.rateLimiters[key]
+	}
+	if l == nil {
+		l = newRateLimiter(opts.rateLimit, rt.cfg.rateLimitStore, name)
+	}
+	rt.rateLimiters[key] = l
+	return l
+}
+
+// getConcurrencyLimiter returns the concurrency limiter for an ingress, reusing an existing one if
+// possible so that in-flight requests keep counting against the limit. It returns nil if the
+// ingress's concurrency isn't limited.
+func (rt *RoutingTable) getConcurrencyLimiter(ingressPayload watcher.IngressPayload, opts *ingressOptions, prev *RoutingTable) *concurrencyLimiter {
+	if opts.concurrency == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%s %s", ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name, opts.fingerprint)
+	if l, ok := rt.concurrencyLimits[key]; ok {
+		return l
+	}
+	var l *concurrencyLimiter
+	if prev != nil {
+		l = prev.concurrencyLimits[key]
+	}
+	if l == nil {
+		l = newConcurrencyLimiter(opts.concurrency)
+	}
+	rt.concurrencyLimits[key] = l
+	return l
+}
+
+// getCache returns the response cache for an ingress, reusing an existing one if possible so that
+// stored responses survive unrelated changes. It returns nil if the ingress's responses aren't cached.
+func (rt *RoutingTable) getCache(ingressPayload watcher.IngressPayload, opts *ingressOptions, prev *RoutingTable) *responseCache {
+	if opts.cache == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s/%s %s", ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name, opts.fingerprint)
+	if c, ok := rt.caches[key]; ok {
+		return c
+	}
+	var c *responseCache
+	if prev != nil {
+		c = prev.caches[key]
+	}
+	if c == nil {
+		var dir string
+		if opts.cache.diskSize > 0 {
+			if rt.cfg.cacheDir == "" {
+				log.Warn().
+					Str("namespace", ingressPayload.Ingress.Namespace).
+					Str("name", ingressPayload.Ingress.Name).
+					Msg("no cache directory configured, only caching responses in memory")
+			} else {
+				dir = filepath.Join(rt.cfg.cacheDir, fmt.Sprintf("%s-%s-%s",
+					ingressPayload.Ingress.Namespace, ingressPayload.Ingress.Name, opts.fingerprint[:16]))
+			}
+		}
+		c = newResponseCache(opts.cache, dir, rt.cfg.requestIDHeader)
+	}
+	rt.caches[key] = c
+	return c
+}
+
+// purgeCache removes the stored responses with the given key, or with keys starting with it if
+// prefix is set, from every response cache. It returns the number of removed responses.
+func (rt *RoutingTable) purgeCache(key string, prefix bool) int {
+	n := 0
+	for _, c := range rt.caches {
+		n += c.purge(key, prefix)
+	}
+	return n
+}
+
+// closeUnused closes the backend proxies and response caches that aren't used by the next routing
+// table.
+func (rt *RoutingTable) closeUnused(next *RoutingTable) {
+	for key, bp := range rt.proxies {
+		if _, ok := next.proxies[key]; !ok {
+			bp.close()
+		}
+	}
+	for key, c := range rt.caches {
+		if _, ok := next.caches[key]; !ok {
+			c.close()
+		}
+	}
+}
+
 func (rt *RoutingTable) getServicePort(ingressPayload watcher.IngressPayload, serviceName string, servicePort intstr.IntOrString) int {
 	if servicePort.Type == intstr.Int {
 		return servicePort.IntValue()
@@ -125,6 +319,17 @@ func (rt *RoutingTable) getServicePort(ingressPayload watcher.IngressPayload, se
 	return 80
 }
 
+// getServiceEndpoints returns the ready endpoints for the given service port. If the endpoints aren't
+// known, requests are sent to the service address.
+func (rt *RoutingTable) getServiceEndpoints(ingressPayload watcher.IngressPayload, serviceName string, servicePort int) []string {
+	for name, port := range ingressPayload.ServicePorts[serviceName] {
+		if port == servicePort {
+			return ingressPayload.ServiceEndpoints[serviceName][name]
+		}
+	}
+	return nil
+}
+
 func (rt *RoutingTable) matches(sni string, certHost string) bool {
 	for strings.HasPrefix(certHost, "*.") {
 		if idx := strings.IndexByte(sni, '.'); idx >= 0 {
@@ -150,16 +355,62 @@ func (rt *RoutingTable) GetCertificate(sni string) (*tls.Certificate, error) {
 	return nil, fmt.Errorf("certificate not found for %s", sni)
 }
 
+// getClientAuth gets the client certificate settings for the given host, or nil if client certificates
+// aren't used.
+func (rt *RoutingTable) getClientAuth(host string) *clientAuth {
+	return rt.clientAuthByHost[stripPort(host)]
+}
+
+// certificates returns all the certificates in the routing table.
+func (rt *RoutingTable) certificates() []*tls.Certificate {
+	seen := make(map[*tls.Certificate]bool)
+	var certs []*tls.Certificate
+	for _, hostCerts := range rt.certificatesByHost {
+		for _, cert := range hostCerts {
+			if !seen[cert] {
+				seen[cert] = true
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs
+}
+
+// getTLSPolicy gets the TLS policy for the given host. It returns false if the host uses the
+// controller-wide policy.
+func (rt *RoutingTable) getTLSPolicy(host string) (TLSPolicy, bool) {
+	policy, ok := rt.tlsPolicyByHost[stripPort(host)]
+	return policy, ok
+}
+
+// allowsHTTP3 returns true if the host's TLS policy allows TLS 1.3, which HTTP/3 requires.
+func (rt *RoutingTable) allowsHTTP3(host string) bool {
+	policy, ok := rt.getTLSPolicy(host)
+	return !ok || policy.allowsTLS13()
+}
+
 // GetBackend gets the backend for the given host and path.
 func (rt *RoutingTable) GetBackend(host, path string) (*url.URL, error) {
-	if idx := strings.IndexByte(host, ':'); idx > 0 {
-		host = host[:idx]
+	backend, err := rt.getBackend(host, path)
+	if err != nil {
+		return nil, err
 	}
-	backends := rt.backendsByHost[host]
-	for _, backend := range backends {
-		if backend.matches(path) {
-			return backend.url, nil
+	return backend.url, nil
+}
+
+func (rt *RoutingTable) getBackend(host, path string) (*routingTableBackend, error) {
+	backends := rt.backendsByHost[stripPort(host)]
+	for i := range backends {
+		if backends[i].matches(path) {
+			return &backends[i], nil
 		}
 	}
 	return nil, errors.New("backend not found")
 }
+
+func stripPort(host string) string {
+	if idx := strings.IndexByte(host, ':'); idx > 0 {
+		return host[:idx]
+	}
+	return host
+}
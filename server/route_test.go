@@ -2,12 +2,16 @@ package server
 
 import (
 	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
 	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
 	"github.com/stretchr/testify/assert"
 	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestRoutingTable(t *testing.T) {
@@ -142,4 +146,166 @@ func TestRoutingTable(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, cert, cert1)
 	})
+	t.Run("backend protocol", func(t *testing.T) {
+		newPayload := func(protocol string) *watcher.Payload {
+			return &watcher.Payload{
+				Ingresses: []watcher.IngressPayload{{
+					Ingress: &networking.Ingress{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{BackendProtocolAnnotation: protocol},
+						},
+						Spec: networking.IngressSpec{
+							DefaultBackend: &networking.IngressBackend{
+								Service: &networking.IngressServiceBackend{
+									Name: "example",
+									Port: networking.ServiceBackendPort{Number: 443},
+								},
+							},
+							Rules: []networking.IngressRule{{Host: "www.example.com"}},
+						},
+					},
+				}},
+			}
+		}
+		for protocol, scheme := range map[string]string{
+			"h2c":   "http",
+			"HTTPS": "https",
+			"grpcs": "https",
+		} {
+			u, err := NewRoutingTable(newPayload(protocol)).GetBackend("www.example.com", "/")
+			if assert.NoError(t, err, protocol) {
+				assert.Equal(t, scheme, u.Scheme, protocol)
+			}
+		}
+
+		u, err := NewRoutingTable(newPayload("ftp")).GetBackend("www.example.com", "/")
+		assert.Error(t, err, "ingresses with invalid annotations should be ignored")
+		assert.Nil(t, u)
+	})
+	t.Run("backend proxies", func(t *testing.T) {
+		newPayload := func(protocol string) *watcher.Payload {
+			backend := networking.IngressBackend{
+				Service: &networking.IngressServiceBackend{
+					Name: "example",
+					Port: networking.ServiceBackendPort{Number: 80},
+				},
+			}
+			return &watcher.Payload{
+				Ingresses: []watcher.IngressPayload{{
+					Ingress: &networking.Ingress{
+						ObjectMeta: metav1.ObjectMeta{
+							Namespace:   "default",
+							Name:        "example",
+							Annotations: map[string]string{BackendProtocolAnnotation: protocol},
+						},
+						Spec: networking.IngressSpec{
+							Rules: []networking.IngressRule{{
+								Host: "www.example.com",
+								IngressRuleValue: networking.IngressRuleValue{
+									HTTP: &networking.HTTPIngressRuleValue{
+										Paths: []networking.HTTPIngressPath{
+											{Path: "^/a", Backend: backend},
+											{Path: "^/b", Backend: backend},
+										},
+									},
+								},
+							}},
+						},
+					},
+				}},
+			}
+		}
+		getProxy := func(rt *RoutingTable, path string) *backendProxy {
+			backend, err := rt.getBackend("www.example.com", path)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			return backend.proxy
+		}
+
+		rt1 := newRoutingTable(defaultConfig(), newPayload("http"), nil)
+		assert.Same(t, getProxy(rt1, "/a"), getProxy(rt1, "/b"), "paths to the same backend should share a proxy")
+
+		rt2 := newRoutingTable(defaultConfig(), newPayload("http"), rt1)
+		assert.Same(t, getProxy(rt1, "/a"), getProxy(rt2, "/a"), "unchanged backends should be reused")
+
+		rt3 := newRoutingTable(defaultConfig(), newPayload("h2c"), rt2)
+		assert.NotSame(t, getProxy(rt2, "/a"), getProxy(rt3, "/a"), "changed backends should be rebuilt")
+		assert.Len(t, rt3.proxies, 1)
+	})
+	t.Run("service endpoints", func(t *testing.T) {
+		rt := NewRoutingTable(&watcher.Payload{
+			Ingresses: []watcher.IngressPayload{{
+				Ingress: &networking.Ingress{Spec: networking.IngressSpec{
+					DefaultBackend: &networking.IngressBackend{
+						Service: &networking.IngressServiceBackend{
+							Name: "example",
+							Port: networking.ServiceBackendPort{Number: 80},
+						},
+					},
+					Rules: []networking.IngressRule{{Host: "www.example.com"}},
+				}},
+				ServicePorts:     map[string]map[string]int{"example": {"http": 80, "metrics": 9090}},
+				ServiceEndpoints: map[string]map[string][]string{"example": {"http": {"10.0.0.1:8080"}, "metrics": {"10.0.0.1:9090"}}},
+			}},
+		})
+		backend, err := rt.getBackend("www.example.com", "/")
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"10.0.0.1:8080"}, backend.proxy.transport.endpoints.Load())
+		}
+	})
+	t.Run("round robin", func(t *testing.T) {
+		var endpoints []string
+		for _, name := range []string{"a", "b"} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, name)
+			}))
+			defer srv.Close()
+			endpoints = append(endpoints, srv.Listener.Addr().String())
+		}
+
+		rt := NewRoutingTable(&watcher.Payload{
+			Ingresses: []watcher.IngressPayload{{
+				Ingress: &networking.Ingress{Spec: networking.IngressSpec{
+					DefaultBackend: &networking.IngressBackend{
+						Service: &networking.IngressServiceBackend{
+							Name: "example",
+							Port: networking.ServiceBackendPort{Number: 80},
+						},
+					},
+					Rules: []networking.IngressRule{{Host: "www.example.com"}},
+				}},
+				ServicePorts:     map[string]map[string]int{"example": {"http": 80}},
+				ServiceEndpoints: map[string]map[string][]string{"example": {"http": endpoints}},
+			}},
+		})
+		backend, err := rt.getBackend("www.example.com", "/")
+		if !assert.NoError(t, err) {
+			return
+		}
+		var names []string
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			backend.proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/", nil))
+			names = append(names, w.Body.String())
+		}
+		assert.ElementsMatch(t, []string{"a", "a", "b", "b"}, names, "requests should be spread across the endpoints")
+	})
+	t.Run("invalid annotations", func(t *testing.T) {
+		for _, annotations := range []map[string]string{
+			{CompressionAnnotation: "maybe"},
+			{CacheAnnotation: "maybe"},
+			{CacheAnnotation: "true", CacheMemorySizeAnnotation: "lots"},
+			{CacheMemorySizeAnnotation: "1Mi"},
+			{AuthBasicSecretAnnotation: "missing"},
+			{AuthBasicRealmAnnotation: "dashboard"},
+			{AuthURLAnnotation: "sso.example.com"},
+			{AuthURLAnnotation: "ftp://sso.example.com"},
+			{AuthURLAnnotation: "http://sso.example.com", AuthCacheTTLAnnotation: "often"},
+			{AuthResponseHeadersAnnotation: "X-Auth-User"},
+		} {
+			_, err := NewRoutingTable(newTestPayload(annotations)).GetBackend("www.example.com", "/a")
+			assert.Error(t, err, "ingresses with invalid annotations should be ignored: %v", annotations)
+		}
+	})
 }
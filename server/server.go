@@ -4,24 +4,30 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	stdlog "log"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/net/http2"
 	"golang.org/x/sync/errgroup"
 )
 
 // A Server serves HTTP pages.
 type Server struct {
-	cfg          *config
-	routingTable atomic.Value
+	cfg               *config
+	routingTable      atomic.Value
+	ocsp              *ocspStapler
+	sessionTicketKeys *sessionTicketKeys
+	metrics           *metrics
+	http3             *http3.Server
 
 	ready *Event
 }
@@ -33,8 +39,21 @@ func New(options ...Option) *Server {
 		o(cfg)
 	}
 	s := &Server{
-		cfg:   cfg,
-		ready: NewEvent(),
+		cfg:               cfg,
+		sessionTicketKeys: newSessionTicketKeys(cfg.sessionTicketRotation),
+		ready:             NewEvent(),
+	}
+	s.metrics = newMetrics(s)
+	if cfg.http3 {
+		s.http3 = &http3.Server{
+			Addr:        fmt.Sprintf("%s:%d", cfg.host, cfg.tlsPort),
+			Handler:     s,
+			TLSConfig:   s.newTLSConfig(),
+			IdleTimeout: cfg.idleTimeout,
+		}
+	}
+	if cfg.ocspStapling {
+		s.ocsp = newOCSPStapler(cfg.ocspResponderURL, cfg.ocspRefreshInterval)
 	}
 	s.routingTable.Store(NewRoutingTable(nil))
 	return s
@@ -42,39 +61,103 @@ func New(options ...Option) *Server {
 
 // Run runs the server.
 func (s *Server) Run(ctx context.Context) error {
-	// don't start listening until the first payload
-	s.ready.Wait(ctx)
+	if s.http3 != nil && !s.cfg.tlsPolicy.allowsTLS13() {
+		return errors.New("http/3 requires tls 1.3")
+	}
 
 	pr, pw := io.Pipe()
 	go readHTTPLogs(pr)
 
 	var eg errgroup.Group
+	eg.Go(func() error {
+		s.sessionTicketKeys.Run(ctx)
+		return nil
+	})
+	if s.cfg.adminPort != 0 {
+		eg.Go(func() error {
+			host := s.cfg.adminHost
+			if host == "" {
+				host = s.cfg.host
+			}
+			srv := http.Server{
+				Addr:     fmt.Sprintf("%s:%d", host, s.cfg.adminPort),
+				Handler:  s.adminHandler(),
+				ErrorLog: stdlog.New(pw, "", 0),
+			}
+			log.Info().Str("addr", srv.Addr).Msg("starting admin HTTP server")
+			err := srv.ListenAndServe()
+			if err != nil {
+				return fmt.Errorf("error serving admin: %w", err)
+			}
+			return nil
+		})
+	}
+
+	// don't start listening until the first payload
+	s.ready.Wait(ctx)
+
+	if s.ocsp != nil {
+		eg.Go(func() error {
+			s.ocsp.Run(ctx, func() []*tls.Certificate {
+				return s.routingTable.Load().(*RoutingTable).certificates()
+			})
+			return nil
+		})
+	}
 	eg.Go(func() error {
 		srv := http.Server{
-			Addr:     fmt.Sprintf("%s:%d", s.cfg.host, s.cfg.tlsPort),
-			Handler:  s,
-			ErrorLog: stdlog.New(pw, "", 0),
+			Addr:              fmt.Sprintf("%s:%d", s.cfg.host, s.cfg.tlsPort),
+			Handler:           s,
+			ErrorLog:          stdlog.New(pw, "", 0),
+			ReadHeaderTimeout: s.cfg.readHeaderTimeout,
+			ReadTimeout:       s.cfg.readTimeout,
+			WriteTimeout:      s.cfg.writeTimeout,
+			IdleTimeout:       s.cfg.idleTimeout,
+			ConnState:         s.metrics.trackConnections("secure"),
+		}
+		srv.TLSConfig = s.newTLSConfig()
+		if !s.cfg.tlsPolicy.allowsHTTP2() {
+			// a non-nil map disables the automatic HTTP/2 support
+			srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 		}
-		srv.TLSConfig = &tls.Config{
-			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				return s.routingTable.Load().(*RoutingTable).GetCertificate(hello.ServerName)
-			},
+		li, err := s.listen("secure", srv.Addr)
+		if err != nil {
+			return fmt.Errorf("error serving tls: %w", err)
 		}
 		log.Info().Str("addr", srv.Addr).Msg("starting secure HTTP server")
-		err := srv.ListenAndServeTLS("", "")
+		err = srv.ServeTLS(li, "", "")
 		if err != nil {
 			return fmt.Errorf("error serving tls: %w", err)
 		}
 		return nil
 	})
+	if s.http3 != nil {
+		eg.Go(func() error {
+			log.Info().Str("addr", s.http3.Addr).Msg("starting HTTP/3 server")
+			err := s.http3.ListenAndServe()
+			if err != nil {
+				return fmt.Errorf("error serving http/3: %w", err)
+			}
+			return nil
+		})
+	}
 	eg.Go(func() error {
 		srv := http.Server{
-			Addr:     fmt.Sprintf("%s:%d", s.cfg.host, s.cfg.port),
-			Handler:  s,
-			ErrorLog: stdlog.New(pw, "", 0),
+			Addr:              fmt.Sprintf("%s:%d", s.cfg.host, s.cfg.port),
+			Handler:           s,
+			ErrorLog:          stdlog.New(pw, "", 0),
+			ReadHeaderTimeout: s.cfg.readHeaderTimeout,
+			ReadTimeout:       s.cfg.readTimeout,
+			WriteTimeout:      s.cfg.writeTimeout,
+			IdleTimeout:       s.cfg.idleTimeout,
+			ConnState:         s.metrics.trackConnections("insecure"),
+		}
+		li, err := s.listen("insecure", srv.Addr)
+		if err != nil {
+			return fmt.Errorf("error serving non-tls: %w", err)
 		}
 		log.Info().Str("addr", srv.Addr).Msg("starting insecure HTTP server")
-		err := srv.ListenAndServe()
+		err = srv.Serve(li)
 		if err != nil {
 			return fmt.Errorf("error serving non-tls: %w", err)
 		}
@@ -85,28 +168,136 @@ func (s *Server) Run(ctx context.Context) error {
 
 // ServeHTTP serves an HTTP request.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	backendURL, err := s.routingTable.Load().(*RoutingTable).GetBackend(r.Host, r.URL.Path)
+	r = setRequestID(w, r, s.cfg.requestIDHeader)
+	r = setForwardedHeaders(r, s.cfg.trustedProxies)
+
+	info := &requestInfo{start: time.Now()}
+	r = withRequestInfo(r, info)
+	r, span := s.startSpan(r)
+	rec := &responseRecorder{ResponseWriter: w}
+	s.serveHTTP(rec, r, info)
+
+	endSpan(span, r, rec.statusCode(), info)
+	s.metrics.observeRequest(r, rec.statusCode(), info)
+	if s.cfg.accessLogger != nil && (info.backend == nil || info.backend.opts.accessLog.sampled()) {
+		s.cfg.accessLogger.log(newAccessLogEntry(r, rec, info, s.cfg.requestIDHeader))
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request, info *requestInfo) {
+	rt := s.routingTable.Load().(*RoutingTable)
+	backend, err := rt.getBackend(r.Host, r.URL.Path)
 	if err != nil {
 		http.Error(w, "upstream server not found", http.StatusNotFound)
 		return
 	}
-	log.Info().Str("host", r.Host).Str("path", r.URL.Path).Str("backend", backendURL.String()).Msg("proxying request")
-	p := httputil.NewSingleHostReverseProxy(backendURL)
-	if backendURL.Scheme == "https" {
-		p.Transport = &http2.Transport{
-			AllowHTTP: true,
+	info.backend = backend
+
+	removeClientCertHeaders(r.Header)
+	if ca := rt.getClientAuth(r.Host); ca != nil && !ca.authorize(r) {
+		requestLogger(r).Info().Str("host", r.Host).Str("path", r.URL.Path).Msg("client certificate rejected")
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+
+	if backend.rateLimiter != nil && !backend.rateLimiter.handle(w, r, stripPort(r.Host)+backend.path()) {
+		return
+	}
+
+	if backend.opts.basicAuth != nil && !backend.opts.basicAuth.authorize(w, r) {
+		return
+	}
+
+	if backend.opts.forwardAuth != nil && !backend.opts.forwardAuth.authorize(w, r) {
+		return
+	}
+
+	if s.http3 != nil && r.TLS != nil && r.ProtoMajor < 3 && rt.allowsHTTP3(r.Host) {
+		// advertise HTTP/3, this fails until the HTTP/3 listener has started
+		_ = s.http3.SetQUICHeaders(w.Header())
+	}
+
+	if policy := s.compressionPolicy(backend); policy != nil {
+		cw := newCompressWriter(w, r, policy)
+		defer cw.Close()
+		w = cw
+	}
+
+	if backend.cache != nil {
+		backend.cache.serve(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.proxy(w, r, backend)
+		}))
+		return
+	}
+	s.proxy(w, r, backend)
+}
+
+// proxy sends a request to a backend.
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, backend *routingTableBackend) {
+	if backend.concurrency != nil {
+		if !backend.concurrency.acquire(r.Context()) {
+			requestLogger(r).Warn().Str("host", r.Host).Str("path", r.URL.Path).Msg("too many concurrent requests")
+			http.Error(w, "too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer backend.concurrency.release()
+	}
+
+	requestLogger(r).Debug().Str("host", r.Host).Str("path", r.URL.Path).Str("backend", backend.url.String()).Msg("proxying request")
+	s.injectSpan(r)
+	backend.proxy.ServeHTTP(w, r)
+}
+
+// compressionPolicy returns the compression policy of a backend, or nil if its responses aren't
+// compressed.
+func (s *Server) compressionPolicy(backend *routingTableBackend) *CompressionPolicy {
+	if opts := backend.opts.compression; opts != nil {
+		if opts.disabled {
+			return nil
 		}
+		return &opts.policy
 	}
-	p.ErrorLog = stdlog.New(log.Logger, "", 0)
-	p.ServeHTTP(w, r)
+	return s.cfg.compression
+}
+
+// ObserveWatcherEvent records an event seen by the watcher in the metrics.
+func (s *Server) ObserveWatcherEvent(resource, event string) {
+	s.metrics.watcherEvents.WithLabelValues(resource, event).Inc()
 }
 
 // Update updates the server with new ingress rules.
 func (s *Server) Update(payload *watcher.Payload) {
-	s.routingTable.Store(NewRoutingTable(payload))
+	prev := s.routingTable.Load().(*RoutingTable)
+	start := time.Now()
+	rt := newRoutingTable(s.cfg, payload, prev)
+	s.metrics.routingTableRebuilds.Observe(time.Since(start).Seconds())
+	s.routingTable.Store(rt)
+	prev.closeUnused(rt)
+	if payload != nil {
+		s.sessionTicketKeys.SetSecret(payload.SessionTicketSecret)
+	}
+	if s.ocsp != nil {
+		s.ocsp.Refresh()
+	}
 	s.ready.Set()
 }
 
+// listen listens on the given address, decoding PROXY protocol headers and limiting the number of
+// client connections if configured.
+func (s *Server) listen(name, addr string) (net.Listener, error) {
+	if s.cfg.proxyProtocol && len(s.cfg.proxyProtocolTrusted) == 0 {
+		return nil, errors.New("proxy protocol requires trusted networks")
+	}
+	li, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.proxyProtocol {
+		li = newProxyProtocolListener(li, s.cfg.proxyProtocolTrusted)
+	}
+	return newLimitListener(li, name, s.cfg.maxConnections, s.cfg.connectionQueueTimeout), nil
+}
+
 func readHTTPLogs(r io.Reader) {
 	br := bufio.NewReader(r)
 	for {
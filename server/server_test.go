@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,14 +14,16 @@ import (
 	"time"
 
 	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
 	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestServer(t *testing.T) {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
-	ctx, _ = context.WithTimeout(ctx, time.Second*30)
 
 	httpPort, tlsPort := getFreePort(t), getFreePort(t)
 	svcAPort := getFreePort(t)
@@ -36,18 +40,19 @@ func TestServer(t *testing.T) {
 			_ = srv.Close()
 		}()
 		err := srv.ListenAndServe()
-		if err != nil {
-			t.Fatal(err)
+		if err != nil && err != http.ErrServerClosed {
+			t.Error(err)
 		}
 	}()
 
 	s := New(WithHost("127.0.0.1"),
 		WithPort(httpPort),
-		WithTLSPort(tlsPort))
+		WithTLSPort(tlsPort),
+		WithAdminPort(getFreePort(t)))
 	go func() {
 		err := s.Run(ctx)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 	}()
 
@@ -131,3 +136,136 @@ func waitForPort(ctx context.Context, port int) bool {
 	}
 	panic("impossible")
 }
+
+func TestServerHTTP3(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	tlsPort, svcAPort := getFreePort(t), getFreePort(t)
+
+	backend := &http.Server{
+		Addr: fmt.Sprintf("127.0.0.1:%d", svcAPort),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "svc-a")
+		}),
+	}
+	go func() { _ = backend.ListenAndServe() }()
+	defer backend.Close()
+
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	cert := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "www.example.com"},
+		DNSNames:    []string{"www.example.com", "legacy.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	s := New(WithHost("127.0.0.1"),
+		WithPort(getFreePort(t)),
+		WithTLSPort(tlsPort),
+		WithAdminPort(0),
+		WithOCSPStapling(false),
+		WithHTTP3(true))
+	go func() {
+		err := s.Run(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	newIngress := func(host string, annotations map[string]string) watcher.IngressPayload {
+		return watcher.IngressPayload{
+			Ingress: &networking.Ingress{
+				ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+				Spec: networking.IngressSpec{
+					TLS: []networking.IngressTLS{{
+						Hosts:      []string{host},
+						SecretName: "example",
+					}},
+					Rules: []networking.IngressRule{{
+						Host: host,
+						IngressRuleValue: networking.IngressRuleValue{HTTP: &networking.HTTPIngressRuleValue{
+							Paths: []networking.HTTPIngressPath{{
+								Path: "/",
+								Backend: networking.IngressBackend{
+									Service: &networking.IngressServiceBackend{
+										Name: "127.0.0.1",
+										Port: networking.ServiceBackendPort{Number: int32(svcAPort)},
+									},
+								},
+							}},
+						}},
+					}},
+				},
+			},
+		}
+	}
+	s.Update(&watcher.Payload{
+		Ingresses: []watcher.IngressPayload{
+			newIngress("www.example.com", nil),
+			newIngress("legacy.example.com", map[string]string{TLSMaxVersionAnnotation: "1.2"}),
+		},
+		TLSCertificates: map[string]*tls.Certificate{
+			"example": cert.tlsCertificate(),
+		},
+	})
+
+	if !waitForPort(ctx, tlsPort) {
+		t.Fatalf("tls server never started on %d", tlsPort)
+	}
+
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "www.example.com"}
+	get := func(transport http.RoundTripper) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://127.0.0.1:%d/", tlsPort), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = tlsConfig.ServerName
+		res, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := get(&http.Transport{TLSClientConfig: tlsConfig})
+	_ = res.Body.Close()
+	assert.Equal(t, fmt.Sprintf(`h3=":%d"; ma=2592000`, tlsPort), res.Header.Get("Alt-Svc"))
+
+	legacyConfig := &tls.Config{RootCAs: roots, ServerName: "legacy.example.com"}
+	legacy := &http.Transport{TLSClientConfig: legacyConfig}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://127.0.0.1:%d/", tlsPort), nil)
+	assert.NoError(t, err)
+	req.Host = legacyConfig.ServerName
+	res, err = legacy.RoundTrip(req)
+	if assert.NoError(t, err) {
+		_ = res.Body.Close()
+		assert.Equal(t, uint16(tls.VersionTLS12), res.TLS.Version)
+		assert.Empty(t, res.Header.Get("Alt-Svc"), "hosts without tls 1.3 shouldn't advertise HTTP/3")
+	}
+
+	transport := &http3.Transport{TLSClientConfig: tlsConfig}
+	defer transport.Close()
+	res = get(transport)
+	bs, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	_ = res.Body.Close()
+	assert.Equal(t, 3, res.ProtoMajor)
+	assert.Equal(t, "svc-a", string(bs))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.metrics.tlsHandshakeErrors))
+
+	// handshakes for hosts without a certificate fail on both listeners
+	unknownConfig := &tls.Config{RootCAs: roots, ServerName: "unknown.example.com"}
+	_, err = tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tlsPort), unknownConfig)
+	assert.Error(t, err)
+	unknown := &http3.Transport{TLSClientConfig: unknownConfig}
+	defer unknown.Close()
+	req, err = http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://127.0.0.1:%d/", tlsPort), nil)
+	assert.NoError(t, err)
+	_, err = unknown.RoundTrip(req)
+	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.metrics.tlsHandshakeErrors) == 2
+	}, time.Second*5, time.Millisecond*10, "failed handshakes should be counted")
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// sessionTicketPreviousKeys is the number of previous keys kept around to decrypt older tickets.
+const sessionTicketPreviousKeys = 3
+
+// sessionTicketKeys manages the keys used to encrypt TLS session tickets. Keys are derived from a
+// shared secret and the current rotation period so that every replica uses the same keys without
+// having to coordinate. Without a shared secret, random per-process keys are used.
+type sessionTicketKeys struct {
+	interval time.Duration
+
+	mu     sync.RWMutex
+	secret []byte
+	cfg    *tls.Config
+}
+
+func newSessionTicketKeys(interval time.Duration) *sessionTicketKeys {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &sessionTicketKeys{
+		interval: interval,
+		cfg:      new(tls.Config),
+	}
+}
+
+// Run rotates the keys at the start of every rotation period.
+func (k *sessionTicketKeys) Run(ctx context.Context) {
+	for {
+		now := time.Now()
+		next := time.Unix(0, (k.period(now)+1)*int64(k.interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+		}
+		k.rotate(time.Now())
+	}
+}
+
+// rotate switches to the keys of the current period. Without a shared secret, the TLS package's own
+// automatic key rotation is kept.
+func (k *sessionTicketKeys) rotate(now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.secret) == 0 {
+		return
+	}
+	k.rotateLocked(now)
+}
+
+// SetSecret sets the shared secret the keys are derived from.
+func (k *sessionTicketKeys) SetSecret(secret []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if hmac.Equal(secret, k.secret) {
+		return
+	}
+	k.secret = secret
+	k.rotateLocked(time.Now())
+}
+
+func (k *sessionTicketKeys) rotateLocked(now time.Time) {
+	// replace the config so tickets stop using the previous keys
+	k.cfg = new(tls.Config)
+	if len(k.secret) == 0 {
+		return
+	}
+
+	// the first key encrypts new tickets, the next period's key is included in case another
+	// replica's clock is ahead of ours
+	period := k.period(now)
+	keys := [][32]byte{k.derive(period), k.derive(period + 1)}
+	for i := int64(1); i <= sessionTicketPreviousKeys; i++ {
+		keys = append(keys, k.derive(period-i))
+	}
+	k.cfg.SetSessionTicketKeys(keys)
+}
+
+func (k *sessionTicketKeys) period(now time.Time) int64 {
+	return now.UnixNano() / int64(k.interval)
+}
+
+func (k *sessionTicketKeys) derive(period int64) [32]byte {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(period))
+	h := hmac.New(sha256.New, k.secret)
+	_, _ = h.Write([]byte("session-ticket-key"))
+	_, _ = h.Write(msg[:])
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+func (k *sessionTicketKeys) config() *tls.Config {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cfg
+}
+
+// apply configures the TLS config to encrypt and decrypt session tickets with the keys.
+func (k *sessionTicketKeys) apply(cfg *tls.Config) {
+	cfg.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		return k.config().EncryptTicket(cs, ss)
+	}
+	cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		return k.config().DecryptTicket(identity, cs)
+	}
+}
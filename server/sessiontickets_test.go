@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+	cert := newTestCertificate(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "www.example.com"},
+		DNSNames:    []string{"www.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	// listen starts a TLS server standing in for a replica
+	listen := func(keys *sessionTicketKeys) string {
+		cfg := &tls.Config{
+			Certificates: []tls.Certificate{*cert.tlsCertificate()},
+			MaxVersion:   tls.VersionTLS12,
+		}
+		keys.apply(cfg)
+		li, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = li.Close() })
+		go func() {
+			for {
+				conn, err := li.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}
+		}()
+		return li.Addr().String()
+	}
+
+	clientConfig := &tls.Config{
+		RootCAs:            roots,
+		ServerName:         "www.example.com",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	connect := func(addr string) bool {
+		conn, err := tls.Dial("tcp", addr, clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	keys1, keys2 := newSessionTicketKeys(time.Hour), newSessionTicketKeys(time.Hour)
+	keys1.SetSecret(secret)
+	keys2.SetSecret(secret)
+	replica1, replica2 := listen(keys1), listen(keys2)
+
+	assert.False(t, connect(replica1))
+	assert.True(t, connect(replica2), "sessions should resume on another replica with the same secret")
+
+	// tickets from the previous period can still be decrypted
+	keys2.rotate(time.Now().Add(time.Hour))
+	assert.True(t, connect(replica2))
+
+	keys1.SetSecret([]byte("fedcba9876543210fedcba9876543210"))
+	assert.False(t, connect(replica1), "sessions should not resume after the secret changes")
+
+	t.Run("without a secret", func(t *testing.T) {
+		keys := newSessionTicketKeys(time.Hour)
+		replica := listen(keys)
+		assert.False(t, connect(replica))
+		keys.rotate(time.Now().Add(time.Hour))
+		assert.True(t, connect(replica), "automatic keys should be kept across rotations")
+	})
+}
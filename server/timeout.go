@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+	errRequestTimeout        = errors.New("request timeout")
+)
+
+// The reasons a request to a backend timed out.
+const (
+	timeoutConnect        = "connect"
+	timeoutResponseHeader = "response-header"
+	timeoutRequest        = "request"
+)
+
+// timeoutReason returns why a request to a backend timed out, or an empty string if the error isn't
+// a timeout.
+func timeoutReason(r *http.Request, err error) string {
+	var opErr *net.OpError
+	switch {
+	case errors.Is(context.Cause(r.Context()), errRequestTimeout):
+		return timeoutRequest
+	case errors.Is(err, errResponseHeaderTimeout):
+		return timeoutResponseHeader
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return timeoutConnect
+	}
+	return ""
+}
+
+// A responseHeaderTimeoutTransport fails requests whose response headers aren't received in time.
+// Unlike http.Transport's ResponseHeaderTimeout this works for every transport.
+type responseHeaderTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *responseHeaderTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() {
+		cancel(errResponseHeaderTimeout)
+	})
+	res, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel(nil)
+		if errors.Is(context.Cause(ctx), errResponseHeaderTimeout) {
+			return nil, errResponseHeaderTimeout
+		}
+		return nil, err
+	}
+	// the context has to live as long as the body
+	res.Body = &cancelOnCloseBody{ReadCloser: res.Body, cancel: func() { cancel(nil) }}
+	return res, nil
+}
+
+func (t *responseHeaderTimeoutTransport) CloseIdleConnections() {
+	if c, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	once   sync.Once
+	cancel func()
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.cancel)
+	return err
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTimeouts(t *testing.T) {
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer slow.Close()
+	defer close(done)
+	u, _ := url.Parse(slow.URL)
+
+	for _, tc := range []struct {
+		name string
+		opts *ingressOptions
+	}{
+		{timeoutResponseHeader, &ingressOptions{backendProtocol: BackendProtocolHTTP, responseHeaderTimeout: time.Millisecond * 50}},
+		{timeoutRequest, &ingressOptions{backendProtocol: BackendProtocolHTTP, requestTimeout: time.Millisecond * 50}},
+		{timeoutResponseHeader, &ingressOptions{backendProtocol: BackendProtocolH2C, responseHeaderTimeout: time.Millisecond * 50}},
+	} {
+		bp := newBackendProxy(defaultConfig(), "", u, tc.opts)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		bp.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code, tc.name)
+		assert.Less(t, time.Since(start), time.Second*2, tc.name)
+	}
+
+	t.Run("reasons", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		assert.Equal(t, timeoutConnect, timeoutReason(r, &url.Error{Err: &net.OpError{Op: "dial", Err: timeoutError{}}}))
+		assert.Equal(t, "", timeoutReason(r, &net.OpError{Op: "read", Err: timeoutError{}}))
+
+		ctx, cancel := context.WithTimeoutCause(context.Background(), 0, errRequestTimeout)
+		defer cancel()
+		<-ctx.Done()
+		assert.Equal(t, timeoutRequest, timeoutReason(r.WithContext(ctx), context.DeadlineExceeded))
+	})
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/tls"
+)
+
+// newTLSConfig creates the TLS configuration used by the secure listener.
+func (s *Server) newTLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate:     s.getCertificate,
+		GetConfigForClient: s.getConfigForHandshake,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+	s.cfg.tlsPolicy.apply(cfg)
+	s.sessionTicketKeys.apply(cfg)
+	return cfg
+}
+
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := s.routingTable.Load().(*RoutingTable).GetCertificate(hello.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	if s.ocsp != nil {
+		cert = s.ocsp.Staple(cert)
+	}
+	return cert, nil
+}
+
+// getConfigForHandshake returns the TLS configuration for a handshake and tracks whether the
+// handshake succeeds. Both the TLS and the HTTP/3 listener start their handshakes here.
+func (s *Server) getConfigForHandshake(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg, err := s.getConfigForClient(hello)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = s.newTLSConfig()
+		cfg.GetConfigForClient = nil
+	}
+	s.metrics.trackHandshake(hello.Context(), cfg)
+	return cfg, nil
+}
+
+// getConfigForClient returns the TLS configuration for hosts that need settings other than the
+// listener's defaults. Returning nil uses the listener's configuration.
+func (s *Server) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	rt := s.routingTable.Load().(*RoutingTable)
+	ca := rt.getClientAuth(hello.ServerName)
+	policy, hasPolicy := rt.getTLSPolicy(hello.ServerName)
+	if ca == nil && !hasPolicy {
+		return nil, nil
+	}
+
+	cfg := s.newTLSConfig()
+	cfg.GetConfigForClient = nil
+	if hasPolicy {
+		policy.apply(cfg)
+	}
+	if ca != nil {
+		cfg.ClientAuth = ca.clientAuthType()
+		cfg.ClientCAs = ca.pool
+	}
+	return cfg, nil
+}
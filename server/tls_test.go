@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/calebdoxsey/kubernetes-simple-ingress-controller/watcher"
+	"github.com/stretchr/testify/assert"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCertificate(t *testing.T, parent *testCertificate, template *x509.Certificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (tc *testCertificate) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (tc *testCertificate) tlsCertificate() *tls.Certificate {
+	return &tls.Certificate{
+		Certificate: [][]byte{tc.cert.Raw},
+		PrivateKey:  tc.key,
+		Leaf:        tc.cert,
+	}
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	ca := newTestCertificate(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}})
+
+	s := New()
+	s.Update(&watcher.Payload{
+		Ingresses: []watcher.IngressPayload{{
+			Ingress: &networking.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						AuthTLSSecretAnnotation:       "ca",
+						AuthTLSVerifyClientAnnotation: ClientAuthOptional,
+					},
+				},
+				Spec: networking.IngressSpec{
+					Rules: []networking.IngressRule{{Host: "secure.example.com"}},
+				},
+			},
+			Secrets: map[string]map[string][]byte{
+				"ca": {"ca.crt": ca.pem},
+			},
+		}, {
+			Ingress: &networking.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						TLSMinVersionAnnotation: "1.3",
+					},
+				},
+				Spec: networking.IngressSpec{
+					Rules: []networking.IngressRule{{Host: "modern.example.com"}},
+				},
+			},
+		}},
+	})
+
+	cfg, err := s.getConfigForClient(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	assert.NoError(t, err)
+	assert.Nil(t, cfg, "hosts without client auth should use the listener defaults")
+
+	cfg, err = s.getConfigForClient(&tls.ClientHelloInfo{ServerName: "secure.example.com"})
+	assert.NoError(t, err)
+	if assert.NotNil(t, cfg) {
+		assert.Equal(t, tls.VerifyClientCertIfGiven, cfg.ClientAuth)
+		assert.NotNil(t, cfg.ClientCAs)
+		assert.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos)
+	}
+
+	cfg, err = s.getConfigForClient(&tls.ClientHelloInfo{ServerName: "modern.example.com"})
+	assert.NoError(t, err)
+	if assert.NotNil(t, cfg) {
+		assert.Equal(t, uint16(tls.VersionTLS13), cfg.MinVersion)
+		assert.Equal(t, tls.NoClientCert, cfg.ClientAuth)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A TLSPolicy restricts the TLS versions, cipher suites, curves and ALPN protocols used by the
+// secure listener. Zero values use the Go defaults.
+type TLSPolicy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	NextProtos       []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519": tls.X25519,
+	"p256":   tls.CurveP256,
+	"p384":   tls.CurveP384,
+	"p521":   tls.CurveP521,
+}
+
+var alpnProtocols = map[string]bool{
+	"h2":       true,
+	"http/1.1": true,
+}
+
+// ParseTLSPolicy parses a TLSPolicy. Versions are given as 1.0, 1.1, 1.2 or 1.3, cipher suites by
+// their IANA names, curves as X25519, P256, P384 or P521 and ALPN protocols as h2 or http/1.1. Lists
+// are comma-separated. Empty values are left unset.
+func ParseTLSPolicy(minVersion, maxVersion, cipherSuites, curves, nextProtos string) (TLSPolicy, error) {
+	var p TLSPolicy
+	var err error
+
+	if p.MinVersion, err = parseTLSVersion(minVersion); err != nil {
+		return p, fmt.Errorf("invalid minimum tls version: %w", err)
+	}
+	if p.MaxVersion, err = parseTLSVersion(maxVersion); err != nil {
+		return p, fmt.Errorf("invalid maximum tls version: %w", err)
+	}
+
+	for _, name := range splitList(cipherSuites) {
+		id, err := parseCipherSuite(name)
+		if err != nil {
+			return p, err
+		}
+		p.CipherSuites = append(p.CipherSuites, id)
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[strings.ToLower(strings.Replace(name, "-", "", -1))]
+		if !ok {
+			return p, fmt.Errorf("unknown curve: %s", name)
+		}
+		p.CurvePreferences = append(p.CurvePreferences, id)
+	}
+
+	for _, proto := range splitList(nextProtos) {
+		if !alpnProtocols[proto] {
+			return p, fmt.Errorf("unsupported alpn protocol: %s", proto)
+		}
+		p.NextProtos = append(p.NextProtos, proto)
+	}
+
+	return p, p.validate()
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(version), "tls"), "v")
+	id, ok := tlsVersions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version: %s", version)
+	}
+	return id, nil
+}
+
+func parseCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			if isTLS13Only(suite) {
+				return 0, fmt.Errorf("tls 1.3 cipher suites are not configurable: %s", name)
+			}
+			return suite.ID, nil
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("insecure cipher suite: %s", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite: %s", name)
+}
+
+func isTLS13Only(suite *tls.CipherSuite) bool {
+	return len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13
+}
+
+// merge returns the policy with any values set in override replacing its own.
+func (p TLSPolicy) merge(override TLSPolicy) TLSPolicy {
+	if override.MinVersion != 0 {
+		p.MinVersion = override.MinVersion
+	}
+	if override.MaxVersion != 0 {
+		p.MaxVersion = override.MaxVersion
+	}
+	if override.CipherSuites != nil {
+		p.CipherSuites = override.CipherSuites
+	}
+	if override.CurvePreferences != nil {
+		p.CurvePreferences = override.CurvePreferences
+	}
+	if override.NextProtos != nil {
+		p.NextProtos = override.NextProtos
+	}
+	return p
+}
+
+func (p TLSPolicy) validate() error {
+	if p.MinVersion != 0 && p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return errors.New("the minimum tls version is greater than the maximum tls version")
+	}
+
+	if len(p.CipherSuites) > 0 {
+		if p.MinVersion == tls.VersionTLS13 {
+			return errors.New("cipher suites cannot be configured when only tls 1.3 is allowed")
+		}
+		for _, id := range p.CipherSuites {
+			if !p.supportsCipherSuite(id) {
+				return fmt.Errorf("cipher suite %s is not supported by the allowed tls versions", tls.CipherSuiteName(id))
+			}
+		}
+		if p.allowsHTTP2() && !p.hasHTTP2CipherSuite() {
+			return errors.New("h2 requires the TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or " +
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 cipher suite")
+		}
+	}
+
+	return nil
+}
+
+func (p TLSPolicy) supportsCipherSuite(id uint16) bool {
+	for _, suite := range tls.CipherSuites() {
+		if suite.ID != id {
+			continue
+		}
+		for _, v := range suite.SupportedVersions {
+			if (p.MinVersion == 0 || v >= p.MinVersion) && (p.MaxVersion == 0 || v <= p.MaxVersion) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p TLSPolicy) allowsTLS13() bool {
+	return p.MaxVersion == 0 || p.MaxVersion >= tls.VersionTLS13
+}
+
+func (p TLSPolicy) allowsHTTP2() bool {
+	return p.NextProtos == nil || containsString(p.NextProtos, "h2")
+}
+
+func (p TLSPolicy) hasHTTP2CipherSuite() bool {
+	for _, id := range p.CipherSuites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHostTLSPolicy validates a per-host policy against the controller-wide policy.
+func validateHostTLSPolicy(global, host TLSPolicy) error {
+	merged := global.merge(host)
+	if !global.allowsHTTP2() && host.NextProtos != nil && containsString(host.NextProtos, "h2") {
+		return errors.New("h2 cannot be enabled for a host when it is disabled controller-wide")
+	}
+	return merged.validate()
+}
+
+// apply sets the policy on the TLS config.
+func (p TLSPolicy) apply(cfg *tls.Config) {
+	cfg.MinVersion = p.MinVersion
+	cfg.MaxVersion = p.MaxVersion
+	cfg.CipherSuites = p.CipherSuites
+	cfg.CurvePreferences = p.CurvePreferences
+	if p.NextProtos != nil {
+		cfg.NextProtos = p.NextProtos
+	}
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSPolicy(t *testing.T) {
+	p, err := ParseTLSPolicy("1.2", "TLSv1.3",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+		"X25519,P-256", "h2,http/1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, TLSPolicy{
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS13,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}, p)
+
+	p, err = ParseTLSPolicy("", "", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, TLSPolicy{}, p)
+
+	for _, tc := range []struct {
+		name                                          string
+		minVersion, maxVersion, ciphers, curves, alpn string
+		err                                           string
+	}{
+		{"unknown version", "1.4", "", "", "", "", "invalid minimum tls version: unknown tls version: 1.4"},
+		{"min greater than max", "1.3", "1.2", "", "", "", "the minimum tls version is greater than the maximum tls version"},
+		{"unknown cipher", "", "", "TLS_FAKE", "", "", "unknown cipher suite: TLS_FAKE"},
+		{"insecure cipher", "", "", "TLS_RSA_WITH_RC4_128_SHA", "", "", "insecure cipher suite: TLS_RSA_WITH_RC4_128_SHA"},
+		{"tls 1.3 cipher", "", "", "TLS_AES_128_GCM_SHA256", "", "", "tls 1.3 cipher suites are not configurable: TLS_AES_128_GCM_SHA256"},
+		{"ciphers with tls 1.3 only", "1.3", "", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "", "", "cipher suites cannot be configured when only tls 1.3 is allowed"},
+		{"cipher not supported by version", "1.0", "1.1", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "", "http/1.1", "cipher suite TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 is not supported by the allowed tls versions"},
+		{"h2 cipher missing", "", "", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "", "", "h2 requires the TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 cipher suite"},
+		{"unknown curve", "", "", "", "P224", "", "unknown curve: P224"},
+		{"unknown alpn", "", "", "", "", "h3", "unsupported alpn protocol: h3"},
+	} {
+		_, err := ParseTLSPolicy(tc.minVersion, tc.maxVersion, tc.ciphers, tc.curves, tc.alpn)
+		assert.EqualError(t, err, tc.err, tc.name)
+	}
+}
+
+func TestValidateHostTLSPolicy(t *testing.T) {
+	global := TLSPolicy{MinVersion: tls.VersionTLS12}
+	assert.NoError(t, validateHostTLSPolicy(global, TLSPolicy{MinVersion: tls.VersionTLS13}))
+	assert.Error(t, validateHostTLSPolicy(global, TLSPolicy{MaxVersion: tls.VersionTLS11}))
+
+	global = TLSPolicy{NextProtos: []string{"http/1.1"}}
+	assert.Error(t, validateHostTLSPolicy(global, TLSPolicy{NextProtos: []string{"h2", "http/1.1"}}))
+}
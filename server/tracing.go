@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/calebdoxsey/kubernetes-simple-ingress-controller/server"
+	tracingServiceName = "kubernetes-simple-ingress-controller"
+)
+
+// ParseTracePropagators parses a comma-separated list of trace propagators: tracecontext, baggage,
+// b3 (single header) or b3multi.
+func ParseTracePropagators(names string) (propagation.TextMapPropagator, error) {
+	var propagators []propagation.TextMapPropagator
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "tracecontext":
+			propagators = append(propagators, propagation.TraceContext{})
+		case "baggage":
+			propagators = append(propagators, propagation.Baggage{})
+		case "b3":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case "b3multi":
+			propagators = append(propagators, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("unknown trace propagator: %s", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(propagators...), nil
+}
+
+// NewTracerProvider creates a tracer provider which samples the given ratio of new traces, follows
+// the sampling decision of incoming traces and sends spans to the exporter in batches.
+func NewTracerProvider(exporter sdktrace.SpanExporter, samplingRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", tracingServiceName))),
+	)
+}
+
+// startSpan starts the server span of a request, continuing any trace propagated by the client.
+func (s *Server) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := s.cfg.tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.cfg.tracerProvider.Tracer(tracerName).Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", stripPort(r.Host)),
+			attribute.String("url.path", r.URL.Path),
+		))
+	if ip := clientIP(r); ip != nil {
+		span.SetAttributes(attribute.String("client.address", ip.String()))
+	}
+	return r.WithContext(ctx), span
+}
+
+// injectSpan propagates the request's span to the backend.
+func (s *Server) injectSpan(r *http.Request) {
+	s.cfg.tracePropagator.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+// endSpan records the outcome of a request on its span and ends it.
+func endSpan(span trace.Span, r *http.Request, status int, info *requestInfo) {
+	if info.backend != nil {
+		span.SetName(r.Method + " " + info.backend.path())
+		span.SetAttributes(
+			attribute.String("http.route", info.backend.path()),
+			attribute.String("k8s.namespace.name", info.backend.proxy.namespace),
+			attribute.String("k8s.ingress.name", info.backend.proxy.ingress),
+			attribute.String("ingress.backend", info.backend.url.String()),
+		)
+	}
+	if info.upstreamAddr != "" {
+		span.SetAttributes(attribute.String("ingress.upstream.address", info.upstreamAddr))
+	}
+	if info.upstreamError != "" {
+		span.SetAttributes(attribute.String("ingress.upstream.error", info.upstreamError))
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// An OTLPExporter exports spans to an OpenTelemetry collector using OTLP over HTTP with JSON
+// encoding.
+type OTLPExporter struct {
+	endpoint string
+	headers  http.Header
+	client   *http.Client
+}
+
+// NewOTLPExporter creates a new OTLPExporter. Spans are posted to the endpoint, with /v1/traces
+// added if it has no path, along with the given headers.
+func NewOTLPExporter(endpoint string, headers http.Header) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid otlp endpoint: unsupported scheme %q", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &OTLPExporter{
+		endpoint: u.String(),
+		headers:  headers,
+		client:   &http.Client{Timeout: time.Second * 10},
+	}, nil
+}
+
+// ExportSpans exports spans to the collector.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(newOTLPTraces(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range e.headers {
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error exporting spans: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("error exporting spans: unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// Shutdown shuts down the exporter.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// The OTLP JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		TraceState        string         `json:"traceState,omitempty"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		DoubleValue *float64        `json:"doubleValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+	otlpArrayValue struct {
+		Values []otlpValue `json:"values"`
+	}
+)
+
+func newOTLPTraces(spans []sdktrace.ReadOnlySpan) *otlpTraces {
+	var traces otlpTraces
+	resources := make(map[*resource.Resource]int)
+	for _, span := range spans {
+		ri, ok := resources[span.Resource()]
+		if !ok {
+			ri = len(traces.ResourceSpans)
+			resources[span.Resource()] = ri
+			traces.ResourceSpans = append(traces.ResourceSpans, otlpResourceSpans{
+				Resource: otlpResource{Attributes: newOTLPAttributes(span.Resource().Attributes())},
+			})
+		}
+		rs := &traces.ResourceSpans[ri]
+
+		si := -1
+		for i, ss := range rs.ScopeSpans {
+			if ss.Scope.Name == span.InstrumentationScope().Name && ss.Scope.Version == span.InstrumentationScope().Version {
+				si = i
+				break
+			}
+		}
+		if si < 0 {
+			si = len(rs.ScopeSpans)
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+				Scope: otlpScope{
+					Name:    span.InstrumentationScope().Name,
+					Version: span.InstrumentationScope().Version,
+				},
+			})
+		}
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, newOTLPSpan(span))
+	}
+	return &traces
+}
+
+func newOTLPSpan(span sdktrace.ReadOnlySpan) otlpSpan {
+	sc := span.SpanContext()
+	s := otlpSpan{
+		TraceID:           sc.TraceID().String(),
+		SpanID:            sc.SpanID().String(),
+		TraceState:        sc.TraceState().String(),
+		Name:              span.Name(),
+		Kind:              int(span.SpanKind()),
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime().UnixNano(), 10),
+		Attributes:        newOTLPAttributes(span.Attributes()),
+	}
+	if parent := span.Parent(); parent.SpanID().IsValid() {
+		s.ParentSpanID = parent.SpanID().String()
+	}
+	for _, event := range span.Events() {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(event.Time.UnixNano(), 10),
+			Name:         event.Name,
+			Attributes:   newOTLPAttributes(event.Attributes),
+		})
+	}
+	// the OTLP status codes are ordered differently to the API's
+	switch span.Status().Code {
+	case codes.Ok:
+		s.Status.Code = 1
+	case codes.Error:
+		s.Status.Code = 2
+		s.Status.Message = span.Status().Description
+	}
+	return s
+}
+
+func newOTLPAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, attr := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: string(attr.Key), Value: newOTLPValue(attr.Value)})
+	}
+	return kvs
+}
+
+func newOTLPValue(v attribute.Value) otlpValue {
+	var ov otlpValue
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		ov.BoolValue = &b
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		ov.IntValue = &i
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		ov.DoubleValue = &f
+	case attribute.BOOLSLICE:
+		ov.ArrayValue = &otlpArrayValue{}
+		for _, b := range v.AsBoolSlice() {
+			ov.ArrayValue.Values = append(ov.ArrayValue.Values, newOTLPValue(attribute.BoolValue(b)))
+		}
+	case attribute.INT64SLICE:
+		ov.ArrayValue = &otlpArrayValue{}
+		for _, i := range v.AsInt64Slice() {
+			ov.ArrayValue.Values = append(ov.ArrayValue.Values, newOTLPValue(attribute.Int64Value(i)))
+		}
+	case attribute.FLOAT64SLICE:
+		ov.ArrayValue = &otlpArrayValue{}
+		for _, f := range v.AsFloat64Slice() {
+			ov.ArrayValue.Values = append(ov.ArrayValue.Values, newOTLPValue(attribute.Float64Value(f)))
+		}
+	case attribute.STRINGSLICE:
+		ov.ArrayValue = &otlpArrayValue{}
+		for _, s := range v.AsStringSlice() {
+			ov.ArrayValue.Values = append(ov.ArrayValue.Values, newOTLPValue(attribute.StringValue(s)))
+		}
+	default:
+		s := v.Emit()
+		ov.StringValue = &s
+	}
+	return ov
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	var backendHeaders http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHeaders = r.Header.Clone()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	newServer := func(propagators string) (*Server, *tracetest.InMemoryExporter) {
+		exporter := tracetest.NewInMemoryExporter()
+		propagator, err := ParseTracePropagators(propagators)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		s := New(
+			WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))),
+			WithTracePropagator(propagator))
+		s.Update(newTestPayload(nil, hostOf(backend)))
+		return s, exporter
+	}
+
+	t.Run("traceparent", func(t *testing.T) {
+		s, exporter := newServer("tracecontext,baggage")
+		r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+		r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		r.Header.Set("Baggage", "user=alice")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		spans := exporter.GetSpans()
+		if !assert.Len(t, spans, 1) {
+			return
+		}
+		span := spans[0]
+		assert.Equal(t, "GET ^/a", span.Name)
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+		assert.Contains(t, span.Attributes, attribute.String("k8s.ingress.name", "example"))
+		assert.Contains(t, span.Attributes, attribute.String("k8s.namespace.name", "default"))
+		assert.Contains(t, span.Attributes, attribute.Int("http.response.status_code", http.StatusAccepted))
+
+		assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanContext.SpanID().String()+"-01",
+			backendHeaders.Get("Traceparent"), "the backend should see the ingress span as its parent")
+		assert.Equal(t, "user=alice", backendHeaders.Get("Baggage"))
+	})
+	t.Run("b3", func(t *testing.T) {
+		s, exporter := newServer("tracecontext,b3multi")
+		r := httptest.NewRequest("GET", "http://www.example.com/a", nil)
+		r.Header.Set("X-B3-Traceid", "4bf92f3577b34da6a3ce929d0e0e4736")
+		r.Header.Set("X-B3-Spanid", "00f067aa0ba902b7")
+		r.Header.Set("X-B3-Sampled", "1")
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+			assert.Equal(t, spans[0].SpanContext.SpanID().String(), backendHeaders.Get("X-B3-Spanid"))
+			assert.NotEmpty(t, backendHeaders.Get("Traceparent"))
+		}
+	})
+	t.Run("not found", func(t *testing.T) {
+		s, exporter := newServer("tracecontext")
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://unknown.example.com/", nil))
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, "GET", spans[0].Name)
+			assert.Contains(t, spans[0].Attributes, attribute.Int("http.response.status_code", http.StatusNotFound))
+		}
+	})
+	t.Run("upstream error", func(t *testing.T) {
+		s, exporter := newServer("tracecontext")
+		s.Update(newTestPayload(nil, "127.0.0.1:1"))
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://www.example.com/a", nil))
+		spans := exporter.GetSpans()
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, codes.Error, spans[0].Status.Code)
+			assert.Contains(t, spans[0].Attributes, attribute.String("ingress.upstream.error", "error"))
+		}
+	})
+
+	_, err := ParseTracePropagators("tracecontext,zipkin")
+	assert.Error(t, err)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	var contentType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		contentType = r.Header.Get("Content-Type")
+		bs, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(bs, &body)
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(collector.URL, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tp := NewTracerProvider(exporter, 1)
+	_, span := tp.Tracer("test").Start(context.Background(), "GET ^/a", trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(attribute.String("k8s.ingress.name", "example"), attribute.Int("http.response.status_code", 502))
+	span.SetStatus(codes.Error, "Bad Gateway")
+	span.End()
+	assert.NoError(t, tp.Shutdown(context.Background()))
+
+	assert.Equal(t, "application/json", contentType)
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"key":   "service.name",
+		"value": map[string]interface{}{"stringValue": "kubernetes-simple-ingress-controller"},
+	}, resourceSpans["resource"].(map[string]interface{})["attributes"].([]interface{})[0])
+	s := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "GET ^/a", s["name"])
+	assert.Equal(t, span.SpanContext().TraceID().String(), s["traceId"])
+	assert.Equal(t, float64(2), s["kind"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "Bad Gateway"}, s["status"])
+	assert.Contains(t, s["attributes"], map[string]interface{}{
+		"key":   "http.response.status_code",
+		"value": map[string]interface{}{"intValue": "502"},
+	})
+
+	_, err = NewOTLPExporter("grpc://collector:4317", nil)
+	assert.Error(t, err)
+}
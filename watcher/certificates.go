@@ -0,0 +1,57 @@
+package watcher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	networking "k8s.io/api/networking/v1"
+)
+
+// A CertificateStatus describes a TLS certificate referenced by an ingress.
+type CertificateStatus struct {
+	Namespace  string    `json:"namespace"`
+	Ingress    string    `json:"ingress"`
+	SecretName string    `json:"secretName"`
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	DNSNames   []string  `json:"dnsNames"`
+	NotBefore  time.Time `json:"notBefore"`
+	NotAfter   time.Time `json:"notAfter"`
+	// Expiring is set when the certificate expires within the configured threshold.
+	Expiring bool `json:"expiring"`
+	// UncoveredHosts are the ingress TLS hosts not covered by the certificate.
+	UncoveredHosts []string `json:"uncoveredHosts,omitempty"`
+}
+
+func newCertificateStatus(ingress *networking.Ingress, rec networking.IngressTLS, cert *tls.Certificate,
+	threshold time.Duration, now time.Time) (CertificateStatus, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return CertificateStatus{}, fmt.Errorf("invalid leaf certificate: %w", err)
+		}
+		cert.Leaf = leaf
+	}
+
+	status := CertificateStatus{
+		Namespace:  ingress.Namespace,
+		Ingress:    ingress.Name,
+		SecretName: rec.SecretName,
+		Subject:    leaf.Subject.String(),
+		Issuer:     leaf.Issuer.String(),
+		DNSNames:   leaf.DNSNames,
+		NotBefore:  leaf.NotBefore,
+		NotAfter:   leaf.NotAfter,
+		Expiring:   now.Add(threshold).After(leaf.NotAfter),
+	}
+	for _, host := range rec.Hosts {
+		if leaf.VerifyHostname(host) != nil {
+			status.UncoveredHosts = append(status.UncoveredHosts, host)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestCertificate(t *testing.T, notAfter time.Time, dnsNames ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    notAfter.Add(-time.Hour * 24 * 90),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNewCertificateStatus(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	ingress := &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example"}}
+	rec := networking.IngressTLS{
+		SecretName: "example-tls",
+		Hosts:      []string{"www.example.com", "a.example.com", "api.example.org"},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		cert := newTestCertificate(t, now.Add(time.Hour*24*60), "www.example.com", "*.example.com")
+		status, err := newCertificateStatus(ingress, rec, cert, time.Hour*24*30, now)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "default", status.Namespace)
+		assert.Equal(t, "example", status.Ingress)
+		assert.Equal(t, "example-tls", status.SecretName)
+		assert.Equal(t, "CN=www.example.com", status.Subject)
+		assert.Equal(t, []string{"www.example.com", "*.example.com"}, status.DNSNames)
+		assert.False(t, status.Expiring)
+		assert.Equal(t, []string{"api.example.org"}, status.UncoveredHosts)
+		assert.NotNil(t, cert.Leaf, "the parsed leaf should be kept")
+	})
+	t.Run("expiring", func(t *testing.T) {
+		cert := newTestCertificate(t, now.Add(time.Hour*24*7), "www.example.com")
+		status, err := newCertificateStatus(ingress, rec, cert, time.Hour*24*30, now)
+		if assert.NoError(t, err) {
+			assert.True(t, status.Expiring)
+			assert.Equal(t, []string{"a.example.com", "api.example.org"}, status.UncoveredHosts)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newCertificateStatus(ingress, rec, &tls.Certificate{Certificate: [][]byte{{1, 2, 3}}}, 0, now)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,46 @@
+package watcher
+
+import "time"
+
+type config struct {
+	certificateExpiryThreshold time.Duration
+
+	sessionTicketSecretNamespace string
+	sessionTicketSecretName      string
+
+	eventObserver func(resource, event string)
+}
+
+func defaultConfig() *config {
+	return &config{
+		certificateExpiryThreshold: time.Hour * 24 * 14,
+		eventObserver:              func(resource, event string) {},
+	}
+}
+
+// An Option modifies the config.
+type Option func(*config)
+
+// WithCertificateExpiryThreshold sets how long before a certificate expires to start warning about it
+// in the config.
+func WithCertificateExpiryThreshold(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.certificateExpiryThreshold = threshold
+	}
+}
+
+// WithSessionTicketSecret sets the secret holding the shared TLS session ticket secret in the config.
+func WithSessionTicketSecret(namespace, name string) Option {
+	return func(cfg *config) {
+		cfg.sessionTicketSecretNamespace = namespace
+		cfg.sessionTicketSecretName = name
+	}
+}
+
+// WithEventObserver sets a function called for every add, update or delete event of a watched
+// resource in the config.
+func WithEventObserver(observer func(resource, event string)) Option {
+	return func(cfg *config) {
+		cfg.eventObserver = observer
+	}
+}
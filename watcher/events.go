@@ -0,0 +1,77 @@
+package watcher
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networking "k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "kubernetes-simple-ingress-controller"
+	// eventInterval is the minimum time between repeated events for the same object and reason.
+	eventInterval = time.Hour
+)
+
+// An eventRecorder records Kubernetes events on ingresses.
+type eventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newEventRecorder(client kubernetes.Interface) *eventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return &eventRecorder{
+		broadcaster: broadcaster,
+		recorder:    broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		sent:        make(map[string]time.Time),
+	}
+}
+
+func (er *eventRecorder) shutdown() {
+	er.broadcaster.Shutdown()
+}
+
+// certificateWarnings records warnings about expiring certificates and certificates that don't
+// cover the ingress' TLS hosts.
+func (er *eventRecorder) certificateWarnings(ingress *networking.Ingress, status CertificateStatus) {
+	now := time.Now()
+	switch {
+	case now.After(status.NotAfter):
+		er.warn(ingress, status.SecretName, "CertificateExpired",
+			"certificate in secret %s expired at %s", status.SecretName, status.NotAfter.Format(time.RFC3339))
+	case status.Expiring:
+		er.warn(ingress, status.SecretName, "CertificateExpiring",
+			"certificate in secret %s expires at %s", status.SecretName, status.NotAfter.Format(time.RFC3339))
+	}
+	if len(status.UncoveredHosts) > 0 {
+		er.warn(ingress, status.SecretName, "CertificateHostMismatch",
+			"certificate in secret %s does not cover hosts: %s", status.SecretName, strings.Join(status.UncoveredHosts, ", "))
+	}
+}
+
+func (er *eventRecorder) warn(ingress *networking.Ingress, secretName, reason, messageFmt string, args ...interface{}) {
+	key := ingress.Namespace + "/" + ingress.Name + "/" + secretName + "/" + reason
+	now := time.Now()
+
+	er.mu.Lock()
+	last, ok := er.sent[key]
+	if ok && now.Sub(last) < eventInterval {
+		er.mu.Unlock()
+		return
+	}
+	er.sent[key] = now
+	er.mu.Unlock()
+
+	er.recorder.Eventf(ingress, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
@@ -0,0 +1,67 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCertificateWarnings(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	er := &eventRecorder{recorder: recorder, sent: make(map[string]time.Time)}
+	ingress := &networking.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example"}}
+
+	events := func() []string {
+		var events []string
+		for {
+			select {
+			case event := <-recorder.Events:
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+
+	er.certificateWarnings(ingress, CertificateStatus{
+		SecretName: "valid-tls",
+		NotAfter:   time.Now().Add(time.Hour * 24 * 90),
+	})
+	assert.Empty(t, events(), "valid certificates should not be reported")
+
+	expired := CertificateStatus{
+		SecretName:     "expired-tls",
+		NotAfter:       time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Expiring:       true,
+		UncoveredHosts: []string{"www.example.com", "api.example.com"},
+	}
+	er.certificateWarnings(ingress, expired)
+	assert.Equal(t, []string{
+		"Warning CertificateExpired certificate in secret expired-tls expired at 2020-01-02T03:04:05Z",
+		"Warning CertificateHostMismatch certificate in secret expired-tls does not cover hosts: www.example.com, api.example.com",
+	}, events())
+
+	er.certificateWarnings(ingress, expired)
+	assert.Empty(t, events(), "repeated warnings should be suppressed")
+
+	er.certificateWarnings(ingress, CertificateStatus{
+		SecretName: "expiring-tls",
+		NotAfter:   time.Date(2099, 1, 2, 3, 4, 5, 0, time.UTC),
+		Expiring:   true,
+	})
+	assert.Equal(t, []string{
+		"Warning CertificateExpiring certificate in secret expiring-tls expires at 2099-01-02T03:04:05Z",
+	}, events())
+
+	er.mu.Lock()
+	for key := range er.sent {
+		er.sent[key] = time.Now().Add(-eventInterval)
+	}
+	er.mu.Unlock()
+	er.certificateWarnings(ingress, expired)
+	assert.Len(t, events(), 2, "warnings should be repeated after the interval")
+}
@@ -3,11 +3,15 @@ package watcher
 import (
 	"context"
 	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/bep/debounce"
 	"github.com/rs/zerolog/log"
+	discovery "k8s.io/api/discovery/v1"
 	networking "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
@@ -15,27 +19,49 @@ import (
 	"k8s.io/client-go/tools/cache"
 )
 
+// AnnotationPrefix is the prefix of all the ingress annotations understood by the controller.
+const AnnotationPrefix = "kubernetes-simple-ingress-controller/"
+
+// SessionTicketSecretKey is the key in the session ticket secret holding the shared secret.
+const SessionTicketSecretKey = "ticket.key"
+
+// secretAnnotationSuffix marks annotations whose value is the name of a secret in the ingress' namespace.
+const secretAnnotationSuffix = "-secret"
+
 // A Payload is a collection of Kubernetes data loaded by the watcher.
 type Payload struct {
 	Ingresses       []IngressPayload
 	TLSCertificates map[string]*tls.Certificate
+	Certificates    []CertificateStatus
+	// SessionTicketSecret is the secret used to derive TLS session ticket keys shared by all replicas.
+	SessionTicketSecret []byte
 }
 
-// An IngressPayload is an ingress + its service ports.
+// An IngressPayload is an ingress + its service ports, service endpoints and the secrets referenced by
+// its annotations.
 type IngressPayload struct {
 	Ingress      *networking.Ingress
 	ServicePorts map[string]map[string]int
+	// ServiceEndpoints are the ready endpoint addresses (host:port) by service name and service port name.
+	ServiceEndpoints map[string]map[string][]string
+	Secrets          map[string]map[string][]byte
 }
 
 // A Watcher watches for ingresses in the kubernetes cluster
 type Watcher struct {
+	cfg      *config
 	client   kubernetes.Interface
 	onChange func(*Payload)
 }
 
 // New creates a new Watcher.
-func New(client kubernetes.Interface, onChange func(*Payload)) *Watcher {
+func New(client kubernetes.Interface, onChange func(*Payload), options ...Option) *Watcher {
+	cfg := defaultConfig()
+	for _, o := range options {
+		o(cfg)
+	}
 	return &Watcher{
+		cfg:      cfg,
 		client:   client,
 		onChange: onChange,
 	}
@@ -47,8 +73,15 @@ func (w *Watcher) Run(ctx context.Context) error {
 	secretLister := factory.Core().V1().Secrets().Lister()
 	serviceLister := factory.Core().V1().Services().Lister()
 	ingressLister := factory.Networking().V1().Ingresses().Lister()
+	endpointSliceLister := factory.Discovery().V1().EndpointSlices().Lister()
+
+	events := newEventRecorder(w.client)
+	defer events.shutdown()
 
 	addBackend := func(ingressPayload *IngressPayload, backend networking.IngressBackend) {
+		if backend.Service == nil {
+			return
+		}
 		svc, err := serviceLister.Services(ingressPayload.Ingress.Namespace).Get(backend.Service.Name)
 		if err != nil {
 			log.Error().Err(err).
@@ -62,6 +95,37 @@ func (w *Watcher) Run(ctx context.Context) error {
 			}
 			ingressPayload.ServicePorts[svc.Name] = m
 		}
+
+		slices, err := endpointSliceLister.EndpointSlices(ingressPayload.Ingress.Namespace).
+			List(labels.SelectorFromSet(labels.Set{discovery.LabelServiceName: backend.Service.Name}))
+		if err != nil {
+			log.Error().Err(err).
+				Str("namespace", ingressPayload.Ingress.Namespace).
+				Str("name", backend.Service.Name).
+				Msg("failed to list endpoints")
+			return
+		}
+		endpoints := make(map[string][]string)
+		for _, slice := range slices {
+			for _, port := range slice.Ports {
+				if port.Port == nil {
+					continue
+				}
+				name := ""
+				if port.Name != nil {
+					name = *port.Name
+				}
+				for _, endpoint := range slice.Endpoints {
+					if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+						continue
+					}
+					for _, addr := range endpoint.Addresses {
+						endpoints[name] = append(endpoints[name], net.JoinHostPort(addr, strconv.Itoa(int(*port.Port))))
+					}
+				}
+			}
+		}
+		ingressPayload.ServiceEndpoints[backend.Service.Name] = endpoints
 	}
 
 	onChange := func() {
@@ -69,6 +133,24 @@ func (w *Watcher) Run(ctx context.Context) error {
 			TLSCertificates: make(map[string]*tls.Certificate),
 		}
 
+		if w.cfg.sessionTicketSecretName != "" {
+			secret, err := secretLister.Secrets(w.cfg.sessionTicketSecretNamespace).Get(w.cfg.sessionTicketSecretName)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("namespace", w.cfg.sessionTicketSecretNamespace).
+					Str("name", w.cfg.sessionTicketSecretName).
+					Msg("unknown session ticket secret")
+			} else if key := secret.Data[SessionTicketSecretKey]; len(key) < 32 {
+				log.Error().
+					Str("namespace", w.cfg.sessionTicketSecretNamespace).
+					Str("name", w.cfg.sessionTicketSecretName).
+					Msgf("session ticket secret must have at least 32 bytes in %s", SessionTicketSecretKey)
+			} else {
+				payload.SessionTicketSecret = key
+			}
+		}
+
 		ingresses, err := ingressLister.List(labels.Everything())
 		if err != nil {
 			log.Error().Err(err).Msg("failed to list ingresses")
@@ -77,16 +159,35 @@ func (w *Watcher) Run(ctx context.Context) error {
 
 		for _, ingress := range ingresses {
 			ingressPayload := IngressPayload{
-				Ingress:      ingress,
-				ServicePorts: make(map[string]map[string]int),
+				Ingress:          ingress,
+				ServicePorts:     make(map[string]map[string]int),
+				ServiceEndpoints: make(map[string]map[string][]string),
+				Secrets:          make(map[string]map[string][]byte),
 			}
 			payload.Ingresses = append(payload.Ingresses, ingressPayload)
 
+			for key, name := range ingress.Annotations {
+				if !strings.HasPrefix(key, AnnotationPrefix) || !strings.HasSuffix(key, secretAnnotationSuffix) || name == "" {
+					continue
+				}
+				secret, err := secretLister.Secrets(ingress.Namespace).Get(name)
+				if err != nil {
+					log.Error().
+						Err(err).
+						Str("namespace", ingress.Namespace).
+						Str("name", name).
+						Str("annotation", key).
+						Msg("unknown secret")
+					continue
+				}
+				ingressPayload.Secrets[name] = secret.Data
+			}
+
 			if ingress.Spec.DefaultBackend != nil {
 				addBackend(&ingressPayload, *ingress.Spec.DefaultBackend)
 			}
 			for _, rule := range ingress.Spec.Rules {
-				if rule.HTTP != nil {
+				if rule.HTTP == nil {
 					continue
 				}
 				for _, path := range rule.HTTP.Paths {
@@ -117,6 +218,18 @@ func (w *Watcher) Run(ctx context.Context) error {
 					}
 
 					payload.TLSCertificates[rec.SecretName] = &cert
+
+					status, err := newCertificateStatus(ingress, rec, &cert, w.cfg.certificateExpiryThreshold, time.Now())
+					if err != nil {
+						log.Error().
+							Err(err).
+							Str("namespace", ingress.Namespace).
+							Str("name", rec.SecretName).
+							Msg("invalid tls certificate")
+						continue
+					}
+					payload.Certificates = append(payload.Certificates, status)
+					events.certificateWarnings(ingress, status)
 				}
 			}
 		}
@@ -125,23 +238,28 @@ func (w *Watcher) Run(ctx context.Context) error {
 	}
 
 	debounced := debounce.New(time.Second)
-	handler := cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			debounced(onChange)
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			debounced(onChange)
-		},
-		DeleteFunc: func(obj interface{}) {
-			debounced(onChange)
-		},
+	handler := func(resource string) cache.ResourceEventHandler {
+		return cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				w.cfg.eventObserver(resource, "add")
+				debounced(onChange)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				w.cfg.eventObserver(resource, "update")
+				debounced(onChange)
+			},
+			DeleteFunc: func(obj interface{}) {
+				w.cfg.eventObserver(resource, "delete")
+				debounced(onChange)
+			},
+		}
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		informer := factory.Core().V1().Secrets().Informer()
-		informer.AddEventHandler(handler)
+		informer.AddEventHandler(handler("secrets"))
 		informer.Run(ctx.Done())
 		wg.Done()
 	}()
@@ -149,7 +267,7 @@ func (w *Watcher) Run(ctx context.Context) error {
 	wg.Add(1)
 	go func() {
 		informer := factory.Networking().V1().Ingresses().Informer()
-		informer.AddEventHandler(handler)
+		informer.AddEventHandler(handler("ingresses"))
 		informer.Run(ctx.Done())
 		wg.Done()
 	}()
@@ -157,7 +275,15 @@ func (w *Watcher) Run(ctx context.Context) error {
 	wg.Add(1)
 	go func() {
 		informer := factory.Core().V1().Services().Informer()
-		informer.AddEventHandler(handler)
+		informer.AddEventHandler(handler("services"))
+		informer.Run(ctx.Done())
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		informer := factory.Discovery().V1().EndpointSlices().Informer()
+		informer.AddEventHandler(handler("endpointslices"))
 		informer.Run(ctx.Done())
 		wg.Done()
 	}()
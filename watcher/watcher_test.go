@@ -0,0 +1,107 @@
+package watcher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1"
+	networking "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// watch runs a watcher for the given objects until a payload satisfies ready.
+func watch(t *testing.T, ready func(*Payload) bool, objects ...runtime.Object) *Payload {
+	payloads := make(chan *Payload, 1)
+	w := New(fake.NewSimpleClientset(objects...), func(payload *Payload) {
+		select {
+		case payloads <- payload:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = w.Run(ctx) }()
+
+	timeout := time.After(time.Second * 10)
+	for {
+		select {
+		case payload := <-payloads:
+			if ready(payload) {
+				return payload
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for payload")
+			return nil
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	ingress := &networking.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example"},
+		Spec: networking.IngressSpec{
+			Rules: []networking.IngressRule{{
+				Host: "www.example.com",
+				IngressRuleValue: networking.IngressRuleValue{
+					HTTP: &networking.HTTPIngressRuleValue{
+						Paths: []networking.HTTPIngressPath{{
+							Path: "/",
+							Backend: networking.IngressBackend{
+								Service: &networking.IngressServiceBackend{
+									Name: "example",
+									Port: networking.ServiceBackendPort{Name: "http"},
+								},
+							},
+						}},
+					},
+				},
+			}},
+		},
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "example"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	}
+
+	t.Run("rule with paths", func(t *testing.T) {
+		payload := watch(t, func(payload *Payload) bool {
+			return len(payload.Ingresses) == 1
+		}, ingress, service)
+		if payload != nil {
+			assert.Equal(t, map[string]map[string]int{"example": {"http": 8080}}, payload.Ingresses[0].ServicePorts,
+				"the services of rules with paths should be looked up")
+		}
+	})
+	t.Run("service endpoints", func(t *testing.T) {
+		ready, notReady, name, port := true, false, "http", int32(8080)
+		slice := &discovery.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "example-abcde",
+				Labels:    map[string]string{discovery.LabelServiceName: "example"},
+			},
+			AddressType: discovery.AddressTypeIPv4,
+			Endpoints: []discovery.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: discovery.EndpointConditions{Ready: &ready}},
+				{Addresses: []string{"10.0.0.2"}, Conditions: discovery.EndpointConditions{Ready: &notReady}},
+				{Addresses: []string{"10.0.0.3"}},
+			},
+			Ports: []discovery.EndpointPort{{Name: &name, Port: &port}},
+		}
+		payload := watch(t, func(payload *Payload) bool {
+			return len(payload.Ingresses) == 1 && len(payload.Ingresses[0].ServiceEndpoints["example"]) > 0
+		}, ingress, service, slice)
+		if payload != nil {
+			assert.Equal(t, map[string][]string{"http": {"10.0.0.1:8080", "10.0.0.3:8080"}},
+				payload.Ingresses[0].ServiceEndpoints["example"], "only ready endpoints should be used")
+		}
+	})
+}